@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// errRoomAbandoned stops the allocation of a room resolved while waiting.
+var errRoomAbandoned = errors.New("room was resolved before it got an agent")
+
+// AbandonWaitingRoom handles the resolve of a room that is still waiting
+// for an agent: its assign task is deleted, or stopped when a worker is on
+// it, and the chat is recorded as abandoned. It reports whether the room
+// was waiting, a room with an agent is left to ReleaseRoomAgent.
+func (s *Service) AbandonWaitingRoom(ctx context.Context, data *WebhookMarkAsResolvedRequest) (bool, error) {
+	roomID, serviceID := data.Service.RoomID, data.Service.ID
+
+	// The agent of this session, or of a later one, was already assigned
+	roomAgent, err := s.Agents.RoomAgent(ctx, roomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	if roomAgent != "" {
+		roomService, err := s.Agents.RoomService(ctx, roomID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		if serviceID == 0 || roomService == 0 || roomService >= serviceID {
+			return false, nil
+		}
+	}
+
+	wimr, held, err := s.cancelRoomTask(ctx, roomID, serviceID)
+	if err != nil {
+		return false, err
+	}
+	if wimr == nil {
+		wimr, err = s.unparkResolvedRoom(ctx, roomID, serviceID)
+		if err != nil {
+			return false, err
+		}
+	}
+	if wimr == nil {
+		return false, nil
+	}
+
+	wait := s.abandonedWait(ctx, roomID)
+
+	// A worker on the task holds the chat row in its transaction, writing
+	// it here would wait for the whole allocation. The worker records the
+	// chat once it sees the flag.
+	if held {
+		log.Printf("Room %s is being allocated, the worker records it as abandoned", roomID)
+	} else if err := s.Chats.AbandonChat(ctx, wimr, wait); err != nil {
+		return true, fmt.Errorf("Error recording abandoned chat: %w", err)
+	}
+
+	ev := Event{Type: EventRoomAbandoned, RoomID: roomID}
+	if wait != nil {
+		ev.WaitSeconds = wait.Seconds()
+		log.Printf("Room %s resolved after waiting %s without an agent", roomID, wait.Round(time.Second))
+	} else {
+		log.Printf("Room %s resolved without an agent", roomID)
+	}
+	s.PublishEvent(ctx, ev)
+
+	return true, nil
+}
+
+// abandonedWait is how long the room waited since it arrived, parked or
+// queued, nil when that is not known.
+func (s *Service) abandonedWait(ctx context.Context, roomID string) *time.Duration {
+	arrivedAt, err := s.Rooms.ArrivedAt(ctx, roomID)
+	if err != nil {
+		return nil
+	}
+
+	wait := time.Since(arrivedAt)
+	return &wait
+}
+
+// cancelRoomTask deletes the assign task of the session of the room. A task
+// a worker is on cannot be deleted, the abandoned flag makes it stop. It
+// returns the payload of the task, nil when the room has none, and whether
+// a worker holds the task.
+func (s *Service) cancelRoomTask(ctx context.Context, roomID string, serviceID int) (*WebhookIncomingMessageRequest, bool, error) {
+	for _, queue := range s.assignQueues() {
+		for _, state := range []string{"pending", "scheduled", "retry", "active"} {
+			task, err := s.findRoomTask(queue, state, roomID, serviceID)
+			if errors.Is(err, asynq.ErrQueueNotFound) {
+				break
+			}
+			if errors.Is(err, asynq.ErrTaskNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, false, fmt.Errorf("Error finding task of room %s: %w", roomID, err)
+			}
+
+			var wimr WebhookIncomingMessageRequest
+			if err := json.Unmarshal(task.Payload, &wimr); err != nil {
+				return nil, false, err
+			}
+
+			// Flag first, a worker may pick the task up before it is deleted
+			err = s.Rooms.SetAbandoned(ctx, roomID, wimr.LatestService.ID)
+			if err != nil {
+				return nil, false, fmt.Errorf("Error flagging room %s as abandoned: %w", roomID, err)
+			}
+
+			if state == "active" {
+				return &wimr, true, nil
+			}
+
+			if err := s.Queue.DeleteTask(queue, task.ID); err != nil {
+				log.Printf("Task %s of room %s could not be deleted, the worker will drop it: %v", task.ID, roomID, err)
+				return &wimr, true, nil
+			}
+			log.Printf("Task %s of resolved room %s deleted from %s", task.ID, roomID, queue)
+
+			return &wimr, false, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// unparkResolvedRoom takes the room out of the parked rooms when it waits
+// there for its channel to open.
+func (s *Service) unparkResolvedRoom(ctx context.Context, roomID string, serviceID int) (*WebhookIncomingMessageRequest, error) {
+	wimr, err := s.Rooms.ParkedRoom(ctx, roomID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if serviceID != 0 && wimr.LatestService.ID != 0 && wimr.LatestService.ID != serviceID {
+		return nil, nil
+	}
+
+	if err := s.Rooms.UnparkRoom(ctx, roomID); err != nil {
+		return nil, err
+	}
+
+	return wimr, nil
+}
+
+// recordAbandonedChat stores the chat of a room the assign task drops
+// because it was resolved while waiting. The task's transaction must be
+// rolled back first, it holds the chat row.
+func (s *Service) recordAbandonedChat(ctx context.Context, wimr *WebhookIncomingMessageRequest) {
+	if err := s.Chats.AbandonChat(ctx, wimr, s.abandonedWait(ctx, wimr.RoomID)); err != nil {
+		log.Printf("Error recording abandoned chat of room %s: %v", wimr.RoomID, err)
+	}
+}
+
+// isRoomAbandoned tells the assign task to drop the room. Failing to check
+// does not stop the assignment.
+func (s *Service) isRoomAbandoned(ctx context.Context, wimr *WebhookIncomingMessageRequest) bool {
+	abandoned, err := s.Rooms.IsAbandoned(ctx, wimr.RoomID, wimr.LatestService.ID)
+	if err != nil {
+		log.Printf("Error checking if room %s was abandoned: %v", wimr.RoomID, err)
+		return false
+	}
+
+	return abandoned
+}
+
+func (s *Service) HandleGetAbandonment(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	from := time.Now().Truncate(24 * time.Hour)
+	if s := query.Get("from"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "from must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+
+	to := time.Now()
+	if s := query.Get("to"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "to must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+
+	stats, err := s.Chats.AbandonmentStats(r.Context(), from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get abandonment: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+func (s *Service) CacheAgentStatus(ctx context.Context) error {
+	agents, err := s.Qiscus.GetAllAgents(ctx)
+	if err != nil {
+		return err
+	}
+
+	currentAgentIDs := make(map[string]struct{})
+	for _, agent := range agents.Data.Agents {
+		idStr := strconv.Itoa(agent.ID)
+		currentAgentIDs[idStr] = struct{}{}
+
+		// Messages of an agent may come from either address
+		err := s.Agents.AddAgent(ctx, idStr, []string{agent.Email, agent.SdkEmail})
+		if err != nil {
+			return err
+		}
+
+		wasOnline, err := s.Agents.SetOnline(ctx, idStr, agent.IsAvailable)
+		if err != nil {
+			return err
+		}
+
+		if wasOnline != agent.IsAvailable {
+			evType := EventAgentOffline
+			if agent.IsAvailable {
+				evType = EventAgentOnline
+			}
+			s.PublishEvent(ctx, Event{Type: evType, AgentID: idStr})
+		}
+
+		err = s.Agents.InitCustomerCount(ctx, idStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	existingIDs, err := s.Agents.AgentIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range existingIDs {
+		if _, found := currentAgentIDs[id]; !found {
+			s.Agents.ForgetAgent(ctx, id)
+		}
+	}
+
+	return nil
+}
+
+// InitAgents refreshes the agent cache and releases the parked rooms of
+// every tenant each minute until ctx is done.
+func (ts Tenants) InitAgents(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Minute)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				for _, s := range ts {
+					if err := s.CacheAgentStatus(ctx); err != nil {
+						log.Printf("Agent cache update of tenant %q failed: %v", s.Tenant, err)
+					}
+					log.Printf("Agent cache of tenant %q updated", s.Tenant)
+
+					if err := s.ReleaseParkedRooms(ctx); err != nil {
+						log.Printf("Releasing parked rooms of tenant %q failed: %v", s.Tenant, err)
+					}
+				}
+			case <-ctx.Done():
+				log.Println("Stopping agent status updater")
+				return
+			}
+		}
+	}()
+}
+
+type CachedAgent struct {
+	ID                   string
+	CurrentCustomerCount int
+}
+
+func (s *Service) GetCachedAvailableAgents(ctx context.Context) ([]CachedAgent, error) {
+	var availableAgents []CachedAgent
+
+	agentIDs, err := s.Agents.AgentIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting agent IDs: %w", err)
+	}
+
+	for _, id := range agentIDs {
+		count, err := s.Agents.CustomerCount(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				availableAgents = append(availableAgents, CachedAgent{
+					ID: id, CurrentCustomerCount: 0,
+				})
+			} else {
+				return nil, fmt.Errorf("error getting customer count for %s: %w", id, err)
+			}
+			continue
+		}
+
+		if count < int(s.conf().WebhookConfig.MaxCurrentCustomer) {
+			availableAgents = append(availableAgents, CachedAgent{
+				ID: id, CurrentCustomerCount: count,
+			})
+		}
+	}
+
+	return availableAgents, nil
+}
+
+// GetAvailableAgentWithCustomerCount retries FindAvailableAgent until an
+// agent is found, the allocation wait is over or the room is resolved. The
+// explanation is the one of the last pass.
+func (s *Service) GetAvailableAgentWithCustomerCount(ctx context.Context, wimr *WebhookIncomingMessageRequest, maxCustomerCount int) (agentID string, exp *Explanation, err error) {
+	maxRetryDuration := s.conf().QueueConfig.AllocationWait
+	retryInterval := s.conf().QueueConfig.AllocationRetryInterval
+	roomID := wimr.RoomID
+
+	start := time.Now()
+
+	for time.Since(start) < maxRetryDuration {
+		if s.isRoomAbandoned(ctx, wimr) {
+			return "", exp, errRoomAbandoned
+		}
+
+		exp, err = s.explainAvailableAgent(ctx, roomID, maxCustomerCount, true)
+		if err != nil {
+			return "", exp, err
+		}
+
+		if exp.AgentID != "" {
+			logFoundAgent(roomID, exp)
+			return exp.AgentID, exp, nil
+		}
+
+		log.Printf("Retrying allocate agent for room %s", roomID)
+		select {
+		case <-ctx.Done():
+			return "", exp, ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+	return "", exp, fmt.Errorf("Can not find any available agent")
+}
+
+func isExcluded(exclude []string, agentID string) bool {
+	for _, id := range exclude {
+		if id == agentID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FindAvailableAgent makes a single pass over the cached agents and asks
+// Qiscus when some customer counts are unknown. Agents in exclude are
+// skipped. An empty agentID means nobody is available right now.
+func (s *Service) FindAvailableAgent(ctx context.Context, roomID string, maxCustomerCount int, exclude ...string) (agentID string, err error) {
+	exp, err := s.explainAvailableAgent(ctx, roomID, maxCustomerCount, true, exclude...)
+	if err != nil {
+		return "", err
+	}
+
+	logFoundAgent(roomID, exp)
+	return exp.AgentID, nil
+}
+
+func logFoundAgent(roomID string, exp *Explanation) {
+	if exp.AgentID == "" {
+		return
+	}
+
+	count := 0
+	if c := exp.Candidates[0].CustomerCount; c != nil {
+		count = *c
+	}
+	log.Printf("Found agent %s for room %s from %s with current customer count %d", exp.AgentID, roomID, exp.Source, count)
+}
+
+// ReleaseRoomAgent gives the slot of the agent serving the service session
+// of the room back, serviceID 0 is the current session. Rooms without a
+// cached agent, or whose agent already serves a later session, release
+// fallbackAgentID instead. It returns the agent whose slot was released, or
+// 0 when there was no counter to decrease.
+func (s *Service) ReleaseRoomAgent(ctx context.Context, roomID string, serviceID, fallbackAgentID int) (int, error) {
+	agentID := fallbackAgentID
+
+	roomAgent, err := s.Agents.RoomAgent(ctx, roomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to find room %s", roomID)
+		return 0, fmt.Errorf("Failed to find room agent")
+	}
+
+	roomService, err := s.Agents.RoomService(ctx, roomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to find session of room %s", roomID)
+		return 0, fmt.Errorf("Failed to find room session")
+	}
+
+	if id, _ := strconv.Atoi(roomAgent); id > 0 {
+		if serviceID != 0 && roomService != 0 && roomService != serviceID {
+			log.Printf("Agent %d of room %s serves session %d, not the resolved session %d", id, roomID, roomService, serviceID)
+		} else {
+			log.Printf("Found agent %d of room %s", id, roomID)
+			agentID = id
+		}
+	}
+
+	agentIDStr := strconv.Itoa(agentID)
+	customerCount, err := s.Agents.CustomerCount(ctx, agentIDStr)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return 0, nil
+		}
+		log.Printf("Failed to find customer count of agent %d", agentID)
+		return 0, fmt.Errorf("Failed to find customer count key")
+	}
+
+	newCustomerCount, err := s.Agents.ReleaseRoom(ctx, roomID, serviceID, agentIDStr)
+	if err != nil {
+		log.Printf("Failed to decreasing customer count of agent %d, from %d to %d", agentID, customerCount, customerCount-1)
+		return 0, fmt.Errorf("Failed to decrease customer count")
+	}
+
+	log.Printf("Decreasing customer count of agent %d, from %d to %d", agentID, customerCount, newCustomerCount)
+
+	if err := s.Rooms.RecordResolve(ctx, roomID, time.Now()); err != nil {
+		log.Printf("Failed to record resolve of room %s: %v", roomID, err)
+	}
+
+	s.PublishEvent(ctx, Event{Type: EventRoomResolved, RoomID: roomID, AgentID: agentIDStr})
+	s.PublishCustomerCount(ctx, agentIDStr, newCustomerCount)
+	s.checkAgentDrained(ctx, agentIDStr, newCustomerCount)
+
+	return agentID, nil
+}
+
+// MoveRoomAgent hands the room and its slot from one agent to another, both
+// counters always change together.
+func (s *Service) MoveRoomAgent(ctx context.Context, roomID string, fromAgentID, toAgentID int) error {
+	from, to := strconv.Itoa(fromAgentID), strconv.Itoa(toAgentID)
+
+	fromCount, toCount, err := s.Agents.MoveRoom(ctx, roomID, from, to)
+	if err != nil {
+		return err
+	}
+
+	// The new agent has not answered yet
+	serviceID, err := s.Agents.RoomService(ctx, roomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to find session of room %s: %v", roomID, err)
+	}
+	if err := s.Rooms.ClearFirstResponse(ctx, roomID, serviceID); err != nil {
+		log.Printf("Failed to reset first response of room %s: %v", roomID, err)
+	}
+
+	log.Printf("Room %s moved from agent %d to %d", roomID, fromAgentID, toAgentID)
+
+	s.PublishEvent(ctx, Event{
+		Type:          EventRoomReassigned,
+		RoomID:        roomID,
+		AgentID:       to,
+		PreviousAgent: from,
+	})
+	s.PublishCustomerCount(ctx, from, fromCount)
+	s.PublishCustomerCount(ctx, to, toCount)
+	s.checkAgentDrained(ctx, from, fromCount)
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memRooms keeps the parts of a RoomStore the tests use in memory, the
+// other methods panic.
+type memRooms struct {
+	RoomStore
+
+	mu            sync.Mutex
+	resolves      []string
+	firstResponse map[string]time.Time
+	cleared       []string
+}
+
+func (m *memRooms) ClearActivity(ctx context.Context, roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cleared = append(m.cleared, roomID)
+	return nil
+}
+
+func (m *memRooms) RecordResolve(ctx context.Context, roomID string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.resolves = append(m.resolves, roomID)
+	return nil
+}
+
+func (m *memRooms) SetFirstResponse(ctx context.Context, roomID string, serviceID int, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := fmt.Sprintf("%s:%d", roomID, serviceID)
+	if _, ok := m.firstResponse[key]; !ok {
+		m.firstResponse[key] = t
+	}
+	return nil
+}
+
+func (m *memRooms) FirstResponseAt(ctx context.Context, roomID string, serviceID int) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.firstResponse[fmt.Sprintf("%s:%d", roomID, serviceID)]
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	return t, nil
+}
+
+func (m *memRooms) ClearFirstResponse(ctx context.Context, roomID string, serviceID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.firstResponse, fmt.Sprintf("%s:%d", roomID, serviceID))
+	return nil
+}
+
+// memEvents records the published events.
+type memEvents struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (m *memEvents) Publish(ctx context.Context, ev Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events = append(m.events, ev)
+	return nil
+}
+
+func (m *memEvents) Subscribe(ctx context.Context) (<-chan Event, error) {
+	return nil, errors.New("not supported")
+}
+
+func (m *memEvents) types() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	types := make([]string, len(m.events))
+	for i, ev := range m.events {
+		types[i] = ev.Type
+	}
+	return types
+}
+
+// newTestService returns a default tenant with its stores in memory.
+func newTestService(t *testing.T) (*Service, *memAgentStore, *memRooms, *memEvents) {
+	t.Helper()
+
+	c := defaultConfig()
+	agents := newMemAgentStore()
+	rooms := &memRooms{firstResponse: map[string]time.Time{}}
+	events := &memEvents{}
+
+	s := &Service{
+		Agents: agents,
+		Rooms:  rooms,
+		Events: events,
+		config: newConfigHolder(&c),
+	}
+	return s, agents, rooms, events
+}
+
+func TestReleaseRoomAgent(t *testing.T) {
+	ctx := context.Background()
+	s, agents, rooms, events := newTestService(t)
+
+	agents.AddAgent(ctx, "1", nil)
+	agents.SetCustomerCount(ctx, "1", 1)
+	agents.AssignRoom(ctx, "room-1", 10, "1")
+
+	agentID, err := s.ReleaseRoomAgent(ctx, "room-1", 10, 0)
+	if err != nil {
+		t.Fatalf("ReleaseRoomAgent: %v", err)
+	}
+	if agentID != 1 {
+		t.Errorf("released agent = %d, want 1", agentID)
+	}
+	if count, _ := agents.CustomerCount(ctx, "1"); count != 1 {
+		t.Errorf("customer count = %d, want 1", count)
+	}
+	if _, err := agents.RoomAgent(ctx, "room-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("room still mapped after release: err = %v", err)
+	}
+	if len(rooms.resolves) != 1 || rooms.resolves[0] != "room-1" {
+		t.Errorf("resolves = %v, want [room-1]", rooms.resolves)
+	}
+
+	got := events.types()
+	if len(got) != 2 || got[0] != EventRoomResolved || got[1] != EventCustomerCountChanged {
+		t.Errorf("events = %v, want room resolved then customer count", got)
+	}
+}
+
+func TestReleaseRoomAgentOfEarlierSession(t *testing.T) {
+	ctx := context.Background()
+	s, agents, _, _ := newTestService(t)
+
+	agents.AddAgent(ctx, "1", nil)
+	agents.AddAgent(ctx, "2", nil)
+	agents.SetCustomerCount(ctx, "1", 0)
+	agents.SetCustomerCount(ctx, "2", 0)
+
+	// The room was re-opened and agent 2 serves its new session when the
+	// resolve of the session agent 1 served arrives late
+	agents.AssignRoom(ctx, "room-1", 11, "2")
+	agents.SetCustomerCount(ctx, "1", 1)
+
+	agentID, err := s.ReleaseRoomAgent(ctx, "room-1", 10, 1)
+	if err != nil {
+		t.Fatalf("ReleaseRoomAgent: %v", err)
+	}
+	if agentID != 1 {
+		t.Errorf("released agent = %d, want the fallback 1", agentID)
+	}
+
+	if count, _ := agents.CustomerCount(ctx, "1"); count != 0 {
+		t.Errorf("customer count of agent 1 = %d, want 0", count)
+	}
+	if count, _ := agents.CustomerCount(ctx, "2"); count != 1 {
+		t.Errorf("customer count of agent 2 = %d, want 1", count)
+	}
+	if id, err := agents.RoomAgent(ctx, "room-1"); err != nil || id != "2" {
+		t.Errorf("room agent = %q, %v, want 2", id, err)
+	}
+}
+
+func TestReleaseRoomAgentUnknownAgent(t *testing.T) {
+	ctx := context.Background()
+	s, _, rooms, events := newTestService(t)
+
+	agentID, err := s.ReleaseRoomAgent(ctx, "room-1", 10, 7)
+	if err != nil {
+		t.Fatalf("ReleaseRoomAgent: %v", err)
+	}
+	if agentID != 0 {
+		t.Errorf("released agent = %d, want 0", agentID)
+	}
+	if len(rooms.resolves) != 0 || len(events.types()) != 0 {
+		t.Errorf("release of an agent without a count recorded %v and published %v", rooms.resolves, events.types())
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+const (
+	// BackendRedis picks the least busy online agent from our Redis cache
+	BackendRedis = "redis"
+	// BackendQiscusCandidate trusts the candidate_agent of the webhook
+	BackendQiscusCandidate = "qiscus_candidate"
+	// BackendQiscusAllocate lets Qiscus allocate and assign the agent
+	BackendQiscusAllocate = "qiscus_allocate"
+	// BackendHybrid uses our rules and falls back to Qiscus allocation
+	BackendHybrid = "hybrid"
+)
+
+// AllocateAgent picks an agent with the configured backend and assigns the
+// room to them in Qiscus. The explanation tells why the agent was picked, it
+// is returned with what is known so far when no agent could be assigned.
+func (s *Service) AllocateAgent(ctx context.Context, wimr *WebhookIncomingMessageRequest) (agentID int, exp *Explanation, err error) {
+	backend := s.conf().Allocation.Backend
+
+	switch backend {
+	case BackendQiscusCandidate:
+		agentID, exp, err = s.allocateCandidateAgent(ctx, wimr)
+	case BackendQiscusAllocate:
+		agentID, exp, err = s.allocateWithQiscus(ctx, wimr)
+	case BackendHybrid:
+		agentID, exp, err = s.allocateHybrid(ctx, wimr)
+	default:
+		agentID, exp, err = s.allocateWithRedis(ctx, wimr)
+	}
+
+	if exp != nil {
+		exp.Backend = backend
+		exp.MaxCustomerCount = int(s.conf().WebhookConfig.MaxCurrentCustomer)
+	}
+	return agentID, exp, err
+}
+
+func (s *Service) assignAgentID(ctx context.Context, wimr *WebhookIncomingMessageRequest, agentID string) (int, error) {
+	agentIDInt, err := strconv.Atoi(agentID)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing available agent id: %w", err)
+	}
+
+	_, err = s.Qiscus.AssignAgent(ctx, wimr.RoomID, agentIDInt)
+	if err != nil {
+		return 0, fmt.Errorf("Error allocating agent: %w", err)
+	}
+
+	return agentIDInt, nil
+}
+
+func (s *Service) allocateWithRedis(ctx context.Context, wimr *WebhookIncomingMessageRequest) (int, *Explanation, error) {
+	agentID, exp, err := s.GetAvailableAgentWithCustomerCount(ctx, wimr, int(s.conf().WebhookConfig.MaxCurrentCustomer))
+	if err != nil {
+		return 0, exp, err
+	}
+
+	agentIDInt, err := s.assignAgentID(ctx, wimr, agentID)
+	return agentIDInt, exp, err
+}
+
+func (s *Service) allocateCandidateAgent(ctx context.Context, wimr *WebhookIncomingMessageRequest) (int, *Explanation, error) {
+	exp := candidateExplanation(wimr)
+
+	candidateID := wimr.CandidateAgent.ID
+	if candidateID == 0 {
+		return 0, exp, fmt.Errorf("Room %s has no candidate agent", wimr.RoomID)
+	}
+
+	_, err := s.Qiscus.AssignAgent(ctx, wimr.RoomID, candidateID)
+	if err != nil {
+		return 0, exp, fmt.Errorf("Error assigning candidate agent: %w", err)
+	}
+
+	return candidateID, exp, nil
+}
+
+func (s *Service) allocateWithQiscus(ctx context.Context, wimr *WebhookIncomingMessageRequest) (int, *Explanation, error) {
+	exp := &Explanation{Source: SourceQiscusAllocate, Candidates: []Candidate{}}
+
+	res, err := s.Qiscus.AllocateAssignAgent(ctx, wimr.RoomID)
+	if err != nil {
+		return 0, exp, err
+	}
+
+	agentID := res.Data.Agent.ID
+	if agentID == 0 {
+		return 0, exp, fmt.Errorf("Qiscus did not allocate any agent for room %s", wimr.RoomID)
+	}
+
+	exp.AgentID = strconv.Itoa(agentID)
+	exp.Candidates = append(exp.Candidates, Candidate{
+		AgentID: exp.AgentID,
+		Reason:  CandidateChosen,
+		Rank:    1,
+	})
+	return agentID, exp, nil
+}
+
+func (s *Service) allocateHybrid(ctx context.Context, wimr *WebhookIncomingMessageRequest) (int, *Explanation, error) {
+	exp, err := s.explainAvailableAgent(ctx, wimr.RoomID, int(s.conf().WebhookConfig.MaxCurrentCustomer), true)
+	if err != nil {
+		log.Printf("Error finding agent for room %s, falling back to Qiscus: %v", wimr.RoomID, err)
+		exp.note("Our rules failed: %v", err)
+	}
+
+	if err == nil && exp.AgentID != "" {
+		logFoundAgent(wimr.RoomID, exp)
+		agentID, err := s.assignAgentID(ctx, wimr, exp.AgentID)
+		return agentID, exp, err
+	}
+
+	log.Printf("No agent for room %s with our rules, falling back to Qiscus", wimr.RoomID)
+	agentID, fallback, err := s.allocateWithQiscus(ctx, wimr)
+
+	// Keep why our rules found nobody
+	fallback.Candidates = append(fallback.Candidates, exp.Candidates...)
+	fallback.Notes = append(fallback.Notes, exp.Notes...)
+	fallback.note("No agent with our rules, allocated by Qiscus")
+	return agentID, fallback, err
+}
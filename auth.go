@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type role int
+
+const (
+	roleViewer role = iota + 1
+	roleOperator
+	roleAdmin
+)
+
+func parseRole(s string) (role, error) {
+	switch strings.ToLower(s) {
+	case "viewer":
+		return roleViewer, nil
+	case "operator":
+		return roleOperator, nil
+	case "admin":
+		return roleAdmin, nil
+	}
+
+	return 0, fmt.Errorf("unknown role %q", s)
+}
+
+func (r role) String() string {
+	switch r {
+	case roleViewer:
+		return "viewer"
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	}
+
+	return "unknown"
+}
+
+type principal struct {
+	Name string
+	Role role
+	// tenants the key acts on, nil for all of them
+	tenants map[string]struct{}
+}
+
+func (p principal) canAccess(tenant string) bool {
+	if p.tenants == nil {
+		return true
+	}
+
+	_, ok := p.tenants[tenant]
+	return ok
+}
+
+// keyTenants turns the tenants of a key into the set of Service.Tenant it
+// can act on.
+func keyTenants(names []string) map[string]struct{} {
+	if len(names) == 0 {
+		return map[string]struct{}{"": {}}
+	}
+
+	tenants := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		switch name {
+		case anyTenant:
+			return nil
+		case defaultTenantName:
+			tenants[""] = struct{}{}
+		default:
+			tenants[name] = struct{}{}
+		}
+	}
+
+	return tenants
+}
+
+type principalContextKey struct{}
+
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(principal)
+	return p, ok
+}
+
+type apiKey struct {
+	key       []byte
+	principal principal
+}
+
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+
+	return ""
+}
+
+// Authenticate resolves the API key or bearer token of the request into a
+// principal. Requests without a known key are rejected.
+func Authenticate(keys []apiKeyConfig) func(http.Handler) http.Handler {
+	known := make([]apiKey, 0, len(keys))
+	for _, k := range keys {
+		r, err := parseRole(k.Role)
+		if err != nil {
+			log.Printf("Ignoring admin key %s: %v", k.Name, err)
+			continue
+		}
+		if k.Key == "" {
+			log.Printf("Ignoring admin key %s: empty key", k.Name)
+			continue
+		}
+
+		known = append(known, apiKey{
+			key:       []byte(k.Key),
+			principal: principal{Name: k.Name, Role: r, tenants: keyTenants(k.Tenants)},
+		})
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given := []byte(requestAPIKey(r))
+			if len(given) == 0 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Missing API key", http.StatusUnauthorized)
+				return
+			}
+
+			for _, k := range known {
+				if subtle.ConstantTimeCompare(given, k.key) == 1 {
+					ctx := context.WithValue(r.Context(), principalContextKey{}, k.principal)
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		})
+	}
+}
+
+// RequireRole only lets through principals with at least the given role.
+func RequireRole(min role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := principalFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Missing API key", http.StatusUnauthorized)
+				return
+			}
+
+			if p.Role < min {
+				http.Error(w, fmt.Sprintf("Role %s is required", min), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireTenant only lets through principals whose key is bound to the
+// tenant of the app_id query parameter, the default tenant without one.
+func RequireTenant(ts Tenants) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := principalFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Missing API key", http.StatusUnauthorized)
+				return
+			}
+
+			s := ts[0]
+			if appID := r.URL.Query().Get("app_id"); appID != "" {
+				s, ok = ts.ByAppID(appID)
+				if !ok {
+					http.Error(w, "Unknown app_id", http.StatusNotFound)
+					return
+				}
+			}
+
+			if !p.canAccess(s.Tenant) {
+				http.Error(w, "The API key cannot act on this tenant", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
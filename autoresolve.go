@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+const TypeChatIdleCheck = "chat:idle_check"
+
+const (
+	idleStageWarn    = "warn"
+	idleStageResolve = "resolve"
+)
+
+// ChatIdleCheckPayload is one step of a room's inactivity chain. Every
+// assignment starts a new chain, steps of older chains are dropped.
+type ChatIdleCheckPayload struct {
+	RoomID   string `json:"room_id"`
+	Chain    string `json:"chain"`
+	Stage    string `json:"stage"`
+	WarnedAt int64  `json:"warned_at,omitempty"`
+}
+
+func (s *Service) enqueueIdleCheck(ctx context.Context, p ChatIdleCheckPayload, delay time.Duration) error {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Queue.Enqueue(ctx, asynq.NewTask(TypeChatIdleCheck, payload), asynq.Queue(s.conf().queue(QUEUE_SCHEDULED)), asynq.ProcessIn(delay))
+	if err != nil {
+		return fmt.Errorf("could not enqueue idle check: %w", err)
+	}
+
+	return nil
+}
+
+// StartIdleTracking starts the inactivity chain of a freshly assigned room.
+func (s *Service) StartIdleTracking(ctx context.Context, roomID string) error {
+	if !s.conf().AutoResolve.Enabled {
+		return nil
+	}
+
+	now := time.Now()
+	chain := strconv.FormatInt(now.UnixMilli(), 10)
+
+	err := s.Rooms.SetLastActivity(ctx, roomID, now)
+	if err != nil {
+		return err
+	}
+
+	err = s.Rooms.SetIdleChain(ctx, roomID, chain)
+	if err != nil {
+		return err
+	}
+
+	return s.enqueueIdleCheck(ctx, ChatIdleCheckPayload{
+		RoomID: roomID,
+		Chain:  chain,
+		Stage:  idleStageWarn,
+	}, s.conf().AutoResolve.IdleTimeout)
+}
+
+// RecordRoomActivity remembers the last message of the room, which pushes
+// its auto resolve back.
+func (s *Service) RecordRoomActivity(ctx context.Context, roomID, commentID string) error {
+	err := s.Rooms.SetLastActivity(ctx, roomID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if commentID != "" {
+		err = s.Rooms.SetLastCommentID(ctx, roomID, commentID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) HandleChatIdleCheckTask(ctx context.Context, task *asynq.Task) error {
+	var p ChatIdleCheckPayload
+	if err := json.Unmarshal(task.Payload(), &p); err != nil {
+		return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+	}
+
+	chain, err := s.Rooms.IdleChain(ctx, p.RoomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if chain != p.Chain {
+		// resolved or reassigned meanwhile
+		return nil
+	}
+
+	_, err = s.Agents.RoomAgent(ctx, p.RoomID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	lastActivity, err := s.Rooms.LastActivity(ctx, p.RoomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	ar := s.conf().AutoResolve
+	idle := time.Since(lastActivity)
+
+	switch p.Stage {
+	case idleStageWarn:
+		if idle < ar.IdleTimeout {
+			return s.enqueueIdleCheck(ctx, p, ar.IdleTimeout-idle)
+		}
+
+		if ar.WarningMessage != "" {
+			if err := s.Qiscus.SendBotMessage(ctx, p.RoomID, ar.WarningMessage); err != nil {
+				return fmt.Errorf("Error sending idle warning: %w", err)
+			}
+
+			log.Printf("Room %s idle for %s, warning sent", p.RoomID, idle.Round(time.Second))
+			p.Stage = idleStageResolve
+			p.WarnedAt = time.Now().UnixMilli()
+			return s.enqueueIdleCheck(ctx, p, ar.WarningGrace)
+		}
+	case idleStageResolve:
+		if lastActivity.UnixMilli() > p.WarnedAt {
+			p.Stage = idleStageWarn
+			p.WarnedAt = 0
+			return s.enqueueIdleCheck(ctx, p, max(ar.IdleTimeout-idle, 0))
+		}
+	default:
+		return fmt.Errorf("unknown idle check stage %q: %w", p.Stage, asynq.SkipRetry)
+	}
+
+	return s.resolveIdleRoom(ctx, p.RoomID, idle)
+}
+
+func (s *Service) resolveIdleRoom(ctx context.Context, roomID string, idle time.Duration) error {
+	wimr, err := s.Chats.GetChat(ctx, roomID)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		wimr = &WebhookIncomingMessageRequest{RoomID: roomID}
+	}
+
+	lastCommentID, err := s.Rooms.LastCommentID(ctx, roomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if lastCommentID != "" {
+		wimr.LatestService.LastCommentID = lastCommentID
+	}
+
+	err = s.Qiscus.Resolve(ctx, roomID, s.conf().AutoResolve.Notes, wimr.LatestService.LastCommentID)
+	if err != nil {
+		return fmt.Errorf("Error resolving idle room %s: %w", roomID, err)
+	}
+
+	log.Printf("Room %s resolved after being idle for %s", roomID, idle.Round(time.Second))
+
+	// The agent's slot is released by the mark_as_resolved webhook Qiscus
+	// sends for this resolve, releasing it here too would count it twice
+	s.Rooms.ClearActivity(ctx, roomID)
+
+	return nil
+}
@@ -2,10 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
+	"strconv"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// dbtx is satisfied by both the pool and a transaction
+type dbtx interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 type DBConfig struct {
 	UrlString string `json:"url_string"`
 }
@@ -16,11 +28,46 @@ func NewDBConfig(urlString string) *DBConfig {
 	}
 }
 
-func IsChatRoomExists(ctx context.Context, tx pgx.Tx, roomID string) (bool, error) {
-	q := `SELECT EXISTS(SELECT 1 FROM chat WHERE room_id = $1)`
+// pgChats is the ChatRepository of one tenant in Postgres. Rows of every
+// tenant but the default one carry its name in their tenant column.
+type pgChats struct {
+	db     dbtx
+	begin  func(ctx context.Context) (pgx.Tx, error)
+	tenant string
+}
+
+func newPgChats(pool *pgxpool.Pool, tenant string) *pgChats {
+	return &pgChats{db: pool, begin: pool.Begin, tenant: tenant}
+}
+
+func (c *pgChats) Begin(ctx context.Context) (ChatTx, error) {
+	tx, err := c.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pgChatTx{pgChats: pgChats{db: tx, begin: tx.Begin, tenant: c.tenant}, tx: tx}, nil
+}
+
+// pgChatTx runs the writes of a pgChats in one transaction.
+type pgChatTx struct {
+	pgChats
+	tx pgx.Tx
+}
+
+func (t *pgChatTx) Commit(ctx context.Context) error {
+	return t.tx.Commit(ctx)
+}
+
+func (t *pgChatTx) Rollback(ctx context.Context) error {
+	return t.tx.Rollback(ctx)
+}
+
+func (c *pgChats) IsChatSessionExists(ctx context.Context, roomID string, serviceID int) (bool, error) {
+	q := `SELECT EXISTS(SELECT 1 FROM chat WHERE tenant = $1 AND room_id = $2 AND service_id = $3)`
 
 	var exists bool
-	err := tx.QueryRow(ctx, q, roomID).Scan(&exists)
+	err := c.db.QueryRow(ctx, q, c.tenant, roomID, serviceID).Scan(&exists)
 
 	if err != nil {
 		return false, err
@@ -29,22 +76,210 @@ func IsChatRoomExists(ctx context.Context, tx pgx.Tx, roomID string) (bool, erro
 	return exists, nil
 }
 
-func CreateChat(ctx context.Context, tx pgx.Tx, wimr *WebhookIncomingMessageRequest) error {
-	q := `INSERT INTO chat(room_id, data) VALUES ( $1, $2 )`
+func (c *pgChats) CreateChat(ctx context.Context, wimr *WebhookIncomingMessageRequest) error {
+	q := `INSERT INTO chat(tenant, room_id, service_id, data) VALUES ( $1, $2, $3, $4 )`
+
+	_, err := c.db.Exec(ctx, q, c.tenant, wimr.RoomID, wimr.LatestService.ID, wimr)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *pgChats) GetChat(ctx context.Context, roomID string) (*WebhookIncomingMessageRequest, error) {
+	q := `SELECT data FROM chat WHERE tenant = $1 AND room_id = $2 ORDER BY id DESC LIMIT 1`
+
+	var wimr WebhookIncomingMessageRequest
+	err := c.db.QueryRow(ctx, q, c.tenant, roomID).Scan(&wimr)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &wimr, nil
+}
+
+func (c *pgChats) UpdateChat(ctx context.Context, wimr *WebhookIncomingMessageRequest) error {
+	q := `UPDATE chat SET status = $1 WHERE tenant = $2 AND room_id = $3 AND service_id = $4`
+
+	_, err := c.db.Exec(ctx, q, "SERVED", c.tenant, wimr.RoomID, wimr.LatestService.ID)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AbandonChat records the session of the room as resolved before it got an
+// agent, after waiting wait. A nil wait is not known. Served chats are left
+// alone.
+func (c *pgChats) AbandonChat(ctx context.Context, wimr *WebhookIncomingMessageRequest, wait *time.Duration) error {
+	q := `INSERT INTO chat(tenant, room_id, service_id, status, data, abandoned_at, wait_seconds)
+	VALUES ( $1, $2, $3, 'ABANDONED', $4, CURRENT_TIMESTAMP, $5 )
+	ON CONFLICT (tenant, room_id, service_id) DO UPDATE
+	SET status = 'ABANDONED', abandoned_at = EXCLUDED.abandoned_at, wait_seconds = EXCLUDED.wait_seconds, updated_at = CURRENT_TIMESTAMP
+	WHERE chat.status = 'UNSERVED'`
+
+	var waitSeconds *float64
+	if wait != nil {
+		seconds := wait.Seconds()
+		waitSeconds = &seconds
+	}
+
+	_, err := c.db.Exec(ctx, q, c.tenant, wimr.RoomID, wimr.LatestService.ID, wimr, waitSeconds)
+	return err
+}
+
+// AbandonmentStats are the chats created in a period and how many of them
+// were abandoned. The waits are nil without abandoned chats of known wait.
+type AbandonmentStats struct {
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	Chats          int       `json:"chats"`
+	Abandoned      int       `json:"abandoned"`
+	Rate           float64   `json:"rate"`
+	AvgWaitSeconds *float64  `json:"avg_wait_seconds"`
+	P50WaitSeconds *float64  `json:"p50_wait_seconds"`
+	P90WaitSeconds *float64  `json:"p90_wait_seconds"`
+	MaxWaitSeconds *float64  `json:"max_wait_seconds"`
+}
+
+func (c *pgChats) AbandonmentStats(ctx context.Context, from, to time.Time) (*AbandonmentStats, error) {
+	q := `SELECT count(*), count(*) FILTER (WHERE status = 'ABANDONED'),
+		avg(wait_seconds) FILTER (WHERE status = 'ABANDONED'),
+		percentile_cont(0.5) WITHIN GROUP (ORDER BY wait_seconds) FILTER (WHERE status = 'ABANDONED'),
+		percentile_cont(0.9) WITHIN GROUP (ORDER BY wait_seconds) FILTER (WHERE status = 'ABANDONED'),
+		max(wait_seconds) FILTER (WHERE status = 'ABANDONED')
+	FROM chat WHERE tenant = $1 AND created_at >= $2 AND created_at < $3`
+
+	stats := AbandonmentStats{From: from, To: to}
+	err := c.db.QueryRow(ctx, q, c.tenant, from, to).Scan(&stats.Chats, &stats.Abandoned,
+		&stats.AvgWaitSeconds, &stats.P50WaitSeconds, &stats.P90WaitSeconds, &stats.MaxWaitSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.Chats > 0 {
+		stats.Rate = float64(stats.Abandoned) / float64(stats.Chats)
+	}
+
+	return &stats, nil
+}
+
+type ShiftBreak struct {
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+}
 
-	_, err := tx.Exec(ctx, q, wimr.RoomID, wimr)
+type AgentShift struct {
+	ID            int          `json:"id"`
+	AgentID       int          `json:"agent_id"`
+	StartsAt      time.Time    `json:"starts_at"`
+	EndsAt        time.Time    `json:"ends_at"`
+	MaxChats      *int         `json:"max_chats"`
+	AssignedChats int          `json:"assigned_chats"`
+	Breaks        []ShiftBreak `json:"breaks"`
+}
 
+func (c *pgChats) CreateShift(ctx context.Context, shift *AgentShift) error {
+	q := `INSERT INTO agent_shift(tenant, agent_id, starts_at, ends_at, max_chats) VALUES ( $1, $2, $3, $4, $5 ) RETURNING id`
+
+	err := c.db.QueryRow(ctx, q, c.tenant, shift.AgentID, shift.StartsAt, shift.EndsAt, shift.MaxChats).Scan(&shift.ID)
 	if err != nil {
 		return err
 	}
 
+	q = `INSERT INTO agent_shift_break(shift_id, starts_at, ends_at) VALUES ( $1, $2, $3 )`
+	for _, b := range shift.Breaks {
+		_, err = c.db.Exec(ctx, q, shift.ID, b.StartsAt, b.EndsAt)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func UpdateChat(ctx context.Context, tx pgx.Tx, wimr *WebhookIncomingMessageRequest) error {
-	q := `UPDATE chat SET status = $1 WHERE room_id = $2`
+func (c *pgChats) ListShifts(ctx context.Context, agentID int, from, to time.Time) ([]AgentShift, error) {
+	q := `SELECT s.id, s.agent_id, s.starts_at, s.ends_at, s.max_chats, s.assigned_chats,
+		COALESCE(json_agg(json_build_object('starts_at', b.starts_at, 'ends_at', b.ends_at) ORDER BY b.starts_at)
+			FILTER (WHERE b.id IS NOT NULL), '[]')
+	FROM agent_shift s
+	LEFT JOIN agent_shift_break b ON b.shift_id = s.id
+	WHERE s.tenant = $4 AND s.starts_at < $2 AND s.ends_at > $1 AND ($3 = 0 OR s.agent_id = $3)
+	GROUP BY s.id
+	ORDER BY s.starts_at, s.agent_id`
+
+	rows, err := c.db.Query(ctx, q, from, to, agentID, c.tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shifts := []AgentShift{}
+	for rows.Next() {
+		var shift AgentShift
+		err := rows.Scan(&shift.ID, &shift.AgentID, &shift.StartsAt, &shift.EndsAt, &shift.MaxChats, &shift.AssignedChats, &shift.Breaks)
+		if err != nil {
+			return nil, err
+		}
+		shifts = append(shifts, shift)
+	}
+
+	return shifts, rows.Err()
+}
+
+func (c *pgChats) DeleteShift(ctx context.Context, shiftID int) (bool, error) {
+	q := `DELETE FROM agent_shift WHERE tenant = $1 AND id = $2`
+
+	tag, err := c.db.Exec(ctx, q, c.tenant, shiftID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
 
-	_, err := tx.Exec(ctx, q, "SERVED", wimr.RoomID)
+// OnShiftAgentIDs returns the agents that can take a new chat at now: inside
+// a shift that does not end before cutoff, not on a break and below the
+// shift's max chats.
+func (c *pgChats) OnShiftAgentIDs(ctx context.Context, now, cutoff time.Time) (map[string]struct{}, error) {
+	q := `SELECT DISTINCT s.agent_id FROM agent_shift s
+	WHERE s.tenant = $3 AND s.starts_at <= $1 AND s.ends_at > $2
+		AND (s.max_chats IS NULL OR s.assigned_chats < s.max_chats)
+		AND NOT EXISTS (
+			SELECT 1 FROM agent_shift_break b
+			WHERE b.shift_id = s.id AND b.starts_at <= $1 AND b.ends_at > $1
+		)`
+
+	rows, err := c.db.Query(ctx, q, now, cutoff, c.tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	agentIDs := make(map[string]struct{})
+	for rows.Next() {
+		var agentID int
+		if err := rows.Scan(&agentID); err != nil {
+			return nil, err
+		}
+		agentIDs[strconv.Itoa(agentID)] = struct{}{}
+	}
+
+	return agentIDs, rows.Err()
+}
+
+func (c *pgChats) IncrementShiftAssignedChats(ctx context.Context, agentID int, now time.Time) error {
+	q := `UPDATE agent_shift SET assigned_chats = assigned_chats + 1 WHERE tenant = $3 AND agent_id = $1 AND starts_at <= $2 AND ends_at > $2`
+
+	_, err := c.db.Exec(ctx, q, agentID, now, c.tenant)
 
 	if err != nil {
 		return err
@@ -52,3 +287,96 @@ func UpdateChat(ctx context.Context, tx pgx.Tx, wimr *WebhookIncomingMessageRequ
 
 	return nil
 }
+
+const (
+	AssignmentKindAssign     = "ASSIGN"
+	AssignmentKindEscalation = "ESCALATION"
+	AssignmentKindTransfer   = "TRANSFER"
+)
+
+type Assignment struct {
+	ID              int          `json:"id"`
+	RoomID          string       `json:"room_id"`
+	ServiceID       int          `json:"service_id"`
+	AgentID         int          `json:"agent_id"`
+	PreviousAgentID *int         `json:"previous_agent_id"`
+	Kind            string       `json:"kind"`
+	Reason          string       `json:"reason"`
+	Actor           string       `json:"actor"`
+	Explanation     *Explanation `json:"explanation,omitempty"`
+	CreatedAt       time.Time    `json:"created_at"`
+}
+
+func (c *pgChats) CreateAssignment(ctx context.Context, a *Assignment) error {
+	q := `INSERT INTO assignment(tenant, room_id, service_id, agent_id, previous_agent_id, kind, reason, actor, explanation) VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9 ) RETURNING id, created_at`
+
+	return c.db.QueryRow(ctx, q, c.tenant, a.RoomID, a.ServiceID, a.AgentID, a.PreviousAgentID, a.Kind, a.Reason, a.Actor, a.Explanation).Scan(&a.ID, &a.CreatedAt)
+}
+
+func (c *pgChats) ListAssignments(ctx context.Context, roomID string, serviceID int) ([]Assignment, error) {
+	q := `SELECT id, room_id, service_id, agent_id, previous_agent_id, kind, reason, actor, explanation, created_at FROM assignment
+	WHERE tenant = $1 AND room_id = $2 AND ($3 = 0 OR service_id = $3) ORDER BY id`
+
+	rows, err := c.db.Query(ctx, q, c.tenant, roomID, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assignments := []Assignment{}
+	for rows.Next() {
+		var a Assignment
+		err := rows.Scan(&a.ID, &a.RoomID, &a.ServiceID, &a.AgentID, &a.PreviousAgentID, &a.Kind, &a.Reason, &a.Actor, &a.Explanation, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, a)
+	}
+
+	return assignments, rows.Err()
+}
+
+// ChatHistory is a chat session with its first assignment, AgentID is 0 for
+// sessions that were never assigned.
+type ChatHistory struct {
+	Chat       WebhookIncomingMessageRequest
+	CreatedAt  time.Time
+	AgentID    int
+	AssignedAt time.Time
+}
+
+// ListChatHistory returns the chats created in [from, to), first created
+// first.
+func (c *pgChats) ListChatHistory(ctx context.Context, from, to time.Time) ([]ChatHistory, error) {
+	q := `SELECT c.data, c.created_at, COALESCE(a.agent_id, 0), a.created_at
+	FROM chat c
+	LEFT JOIN LATERAL (
+		SELECT agent_id, created_at FROM assignment
+		WHERE tenant = c.tenant AND room_id = c.room_id AND service_id = c.service_id AND kind = 'ASSIGN'
+		ORDER BY id LIMIT 1
+	) a ON true
+	WHERE c.tenant = $1 AND c.created_at >= $2 AND c.created_at < $3
+	ORDER BY c.created_at, c.id`
+
+	rows, err := c.db.Query(ctx, q, c.tenant, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []ChatHistory{}
+	for rows.Next() {
+		var h ChatHistory
+		var assignedAt *time.Time
+		err := rows.Scan(&h.Chat, &h.CreatedAt, &h.AgentID, &assignedAt)
+		if err != nil {
+			return nil, err
+		}
+		if assignedAt != nil {
+			h.AssignedAt = *assignedAt
+		}
+		history = append(history, h)
+	}
+
+	return history, rows.Err()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hibiken/asynq"
+)
+
+const TypeAgentDrain = "agent:drain"
+
+// drainCheckDelay is how long a draining agent with an unknown customer
+// count waits before it is checked again.
+const drainCheckDelay = time.Minute
+
+type AgentDrainPayload struct {
+	AgentID string `json:"agent_id"`
+	// Check only looks whether the draining agent is drained by now
+	Check bool `json:"check,omitempty"`
+}
+
+type DrainRequest struct {
+	// At schedules the drain, empty drains right away
+	At *time.Time `json:"at"`
+}
+
+type DrainingAgent struct {
+	AgentID       string `json:"agent_id"`
+	CustomerCount int    `json:"customer_count"`
+}
+
+func drainTaskID(agentID string) string {
+	return fmt.Sprintf("drain:%s", agentID)
+}
+
+func drainCheckTaskID(agentID string) string {
+	return fmt.Sprintf("drain_check:%s", agentID)
+}
+
+// StartDraining stops new assignments to the agent while their current
+// rooms stay with them.
+func (s *Service) StartDraining(ctx context.Context, agentID string) error {
+	err := s.Agents.SetDraining(ctx, agentID, true)
+	if err != nil {
+		return fmt.Errorf("SAdd draining error: %w", err)
+	}
+
+	log.Printf("Agent %s is draining", agentID)
+	s.PublishEvent(ctx, Event{Type: EventAgentDraining, AgentID: agentID})
+
+	count, err := s.Agents.CustomerCount(ctx, agentID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("Get customer_count error: %w", err)
+	}
+	if err != nil {
+		count = -1
+	}
+	s.checkAgentDrained(ctx, agentID, count)
+
+	return nil
+}
+
+// checkAgentDrained reports a draining agent whose last room is gone. A
+// negative count is not known, the agent is checked again later.
+func (s *Service) checkAgentDrained(ctx context.Context, agentID string, customerCount int) {
+	if customerCount > 0 {
+		return
+	}
+
+	draining, err := s.Agents.IsDraining(ctx, agentID)
+	if err != nil {
+		log.Printf("Error checking if agent %s is draining: %v", agentID, err)
+		return
+	}
+	if !draining {
+		return
+	}
+
+	if customerCount < 0 {
+		s.scheduleDrainCheck(ctx, agentID)
+		return
+	}
+
+	log.Printf("Agent %s is drained", agentID)
+	s.PublishEvent(ctx, Event{Type: EventAgentDrained, AgentID: agentID})
+}
+
+// scheduleDrainCheck looks at the draining agent again once its count may
+// be known. A check already scheduled is kept.
+func (s *Service) scheduleDrainCheck(ctx context.Context, agentID string) {
+	payload, err := json.Marshal(AgentDrainPayload{AgentID: agentID, Check: true})
+	if err != nil {
+		log.Printf("Error scheduling drain check of agent %s: %v", agentID, err)
+		return
+	}
+
+	_, err = s.Queue.Enqueue(ctx, asynq.NewTask(TypeAgentDrain, payload),
+		asynq.Queue(s.conf().queue(QUEUE_SCHEDULED)), asynq.TaskID(drainCheckTaskID(agentID)), asynq.ProcessIn(drainCheckDelay))
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		log.Printf("Error scheduling drain check of agent %s: %v", agentID, err)
+		return
+	}
+
+	log.Printf("Customer count of draining agent %s is not known, checking again in %s", agentID, drainCheckDelay)
+}
+
+func (s *Service) HandleAgentDrainTask(ctx context.Context, task *asynq.Task) error {
+	var p AgentDrainPayload
+	if err := json.Unmarshal(task.Payload(), &p); err != nil {
+		return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+	}
+
+	if !p.Check {
+		return s.StartDraining(ctx, p.AgentID)
+	}
+
+	draining, err := s.Agents.IsDraining(ctx, p.AgentID)
+	if err != nil {
+		return err
+	}
+	if !draining {
+		return nil
+	}
+
+	count, err := s.Agents.CustomerCount(ctx, p.AgentID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err != nil || count < 0 {
+		// asynq retries the check with backoff
+		return fmt.Errorf("customer count of draining agent %s is not known yet", p.AgentID)
+	}
+
+	s.checkAgentDrained(ctx, p.AgentID, count)
+	return nil
+}
+
+func (s *Service) HandleListDrainingAgents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	draining, err := s.Agents.DrainingAgents(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get draining agents", http.StatusInternalServerError)
+		return
+	}
+
+	agents := []DrainingAgent{}
+	for id := range draining {
+		count, err := s.Agents.CustomerCount(ctx, id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			http.Error(w, "Failed to get customer count", http.StatusInternalServerError)
+			return
+		}
+		agents = append(agents, DrainingAgent{AgentID: id, CustomerCount: count})
+	}
+
+	writeJSON(w, http.StatusOK, agents)
+}
+
+func (s *Service) HandleDrainAgent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	agentID := chi.URLParam(r, "agent_id")
+
+	if _, err := strconv.Atoi(agentID); err != nil {
+		http.Error(w, "Invalid agent id", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var data DrainRequest
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &data)
+		if err != nil {
+			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A new schedule replaces the previous one
+	err = s.Queue.DeleteTask(s.conf().queue(QUEUE_SCHEDULED), drainTaskID(agentID))
+	if err != nil && !errors.Is(err, asynq.ErrTaskNotFound) && !errors.Is(err, asynq.ErrQueueNotFound) {
+		http.Error(w, fmt.Sprintf("Failed to replace drain schedule: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if data.At != nil && data.At.After(time.Now()) {
+		payload, err := json.Marshal(AgentDrainPayload{AgentID: agentID})
+		if err != nil {
+			http.Error(w, "Failed to schedule drain", http.StatusInternalServerError)
+			return
+		}
+
+		_, err = s.Queue.Enqueue(ctx, asynq.NewTask(TypeAgentDrain, payload),
+			asynq.Queue(s.conf().queue(QUEUE_SCHEDULED)), asynq.TaskID(drainTaskID(agentID)), asynq.ProcessAt(*data.At))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to schedule drain: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Agent %s drain scheduled at %s", agentID, data.At.Format(time.RFC3339))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	err = s.StartDraining(ctx, agentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) HandleUndrainAgent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	agentID := chi.URLParam(r, "agent_id")
+
+	for _, taskID := range []string{drainTaskID(agentID), drainCheckTaskID(agentID)} {
+		err := s.Queue.DeleteTask(s.conf().queue(QUEUE_SCHEDULED), taskID)
+		if err != nil && !errors.Is(err, asynq.ErrTaskNotFound) && !errors.Is(err, asynq.ErrQueueNotFound) {
+			http.Error(w, fmt.Sprintf("Failed to cancel drain schedule: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := s.Agents.SetDraining(ctx, agentID, false)
+	if err != nil {
+		http.Error(w, "Failed to stop draining", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Agent %s is no longer draining", agentID)
+	w.WriteHeader(http.StatusNoContent)
+}
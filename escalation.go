@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+const TypeChatFirstResponseCheck = "chat:first_response_check"
+
+type ChatFirstResponseCheckPayload struct {
+	RoomID     string `json:"room_id"`
+	ServiceID  int    `json:"service_id"`
+	Source     string `json:"source"`
+	AgentID    int    `json:"agent_id"`
+	AssignedAt int64  `json:"assigned_at"`
+}
+
+// firstResponseSLA returns how long an agent has to answer a room of the
+// webhook source.
+func (s *Service) firstResponseSLA(source string) time.Duration {
+	sla := s.conf().SLA
+	if d, ok := sla.Channels[source]; ok {
+		return d
+	}
+
+	return sla.FirstResponse
+}
+
+// StartFirstResponseSLA schedules the check of the agent's first response in
+// the service session of the room.
+func (s *Service) StartFirstResponseSLA(ctx context.Context, roomID string, serviceID int, source string, agentID int) error {
+	if !s.conf().SLA.Enabled {
+		return nil
+	}
+
+	payload, err := json.Marshal(ChatFirstResponseCheckPayload{
+		RoomID:     roomID,
+		ServiceID:  serviceID,
+		Source:     source,
+		AgentID:    agentID,
+		AssignedAt: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Queue.Enqueue(ctx, asynq.NewTask(TypeChatFirstResponseCheck, payload), asynq.Queue(s.conf().queue(QUEUE_SCHEDULED)), asynq.ProcessIn(s.firstResponseSLA(source)))
+	if err != nil {
+		return fmt.Errorf("could not enqueue first response check: %w", err)
+	}
+
+	return nil
+}
+
+// RecordAgentResponse marks the first message of the room's agent in the
+// session it serves.
+func (s *Service) RecordAgentResponse(ctx context.Context, roomID, senderEmail string) error {
+	agentID, err := s.Agents.RoomAgent(ctx, roomID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	serviceID, err := s.Agents.RoomService(ctx, roomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	emails, err := s.Agents.AgentEmails(ctx, agentID)
+	if err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		if strings.EqualFold(email, senderEmail) {
+			return s.Rooms.SetFirstResponse(ctx, roomID, serviceID, time.Now())
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) HandleChatFirstResponseCheckTask(ctx context.Context, task *asynq.Task) error {
+	var p ChatFirstResponseCheckPayload
+	if err := json.Unmarshal(task.Payload(), &p); err != nil {
+		return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+	}
+
+	roomAgent, err := s.Agents.RoomAgent(ctx, p.RoomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if roomAgent != strconv.Itoa(p.AgentID) {
+		// resolved or moved meanwhile
+		return nil
+	}
+
+	roomService, err := s.Agents.RoomService(ctx, p.RoomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if p.ServiceID != 0 && roomService != 0 && roomService != p.ServiceID {
+		// resolved and re-opened meanwhile
+		return nil
+	}
+
+	serviceID := p.ServiceID
+	if serviceID == 0 {
+		serviceID = roomService
+	}
+
+	respondedAt, err := s.Rooms.FirstResponseAt(ctx, p.RoomID, serviceID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err == nil && respondedAt.UnixMilli() >= p.AssignedAt {
+		return nil
+	}
+
+	sla := s.firstResponseSLA(p.Source)
+	log.Printf("Agent %d did not answer room %s within %s, escalating", p.AgentID, p.RoomID, sla)
+
+	previousAgentID := strconv.Itoa(p.AgentID)
+	exp, err := s.explainAvailableAgent(ctx, p.RoomID, int(s.conf().WebhookConfig.MaxCurrentCustomer), true, previousAgentID)
+	if err != nil {
+		return err
+	}
+	logFoundAgent(p.RoomID, exp)
+
+	newAgentID := exp.AgentID
+	if newAgentID == "" {
+		// Retries keep looking for an agent, the escalation is told once
+		if retried, _ := asynq.GetRetryCount(ctx); retried == 0 {
+			s.PublishEvent(ctx, Event{Type: EventRoomEscalated, RoomID: p.RoomID, AgentID: previousAgentID})
+		}
+		return fmt.Errorf("no other agent available for room %s", p.RoomID)
+	}
+
+	newAgentIDInt, err := strconv.Atoi(newAgentID)
+	if err != nil {
+		return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+	}
+
+	err = s.ReassignRoom(ctx, p.RoomID, p.AgentID, newAgentIDInt, AssignmentKindEscalation,
+		fmt.Sprintf("no first response within %s", sla), "sla", exp)
+	if err != nil {
+		return err
+	}
+
+	return s.StartFirstResponseSLA(ctx, p.RoomID, p.ServiceID, p.Source, newAgentIDInt)
+}
+
+// ReassignRoom moves the room to another agent in Qiscus, moves the counters
+// and records the change in the assignment history. exp is nil when the agent
+// was not picked by the allocator. The history is written before the move
+// and committed after it, a move that cannot be recorded is undone so a
+// retry finds the room where it was.
+func (s *Service) ReassignRoom(ctx context.Context, roomID string, fromAgentID, toAgentID int, kind, reason, actor string, exp *Explanation) error {
+	serviceID, err := s.Agents.RoomService(ctx, roomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	tx, err := s.Chats.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.CreateAssignment(ctx, &Assignment{
+		RoomID:          roomID,
+		ServiceID:       serviceID,
+		AgentID:         toAgentID,
+		PreviousAgentID: &fromAgentID,
+		Kind:            kind,
+		Reason:          reason,
+		Actor:           actor,
+		Explanation:     exp,
+	})
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("Error recording assignment: %w", err)
+	}
+
+	if s.conf().Shifts.Enabled {
+		err = tx.IncrementShiftAssignedChats(ctx, toAgentID, time.Now())
+		if err != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("Error counting shift chats: %w", err)
+		}
+	}
+
+	_, err = s.Qiscus.AssignAgent(ctx, roomID, toAgentID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return fmt.Errorf("Error assigning agent %d: %w", toAgentID, err)
+	}
+
+	err = s.Qiscus.RemoveAgent(ctx, roomID, fromAgentID)
+	if err != nil {
+		// The room is already with the new agent, keep going
+		log.Printf("Error removing agent %d from room %s: %v", fromAgentID, roomID, err)
+	}
+
+	err = s.MoveRoomAgent(ctx, roomID, fromAgentID, toAgentID)
+	if err != nil {
+		tx.Rollback(ctx)
+		s.undoReassign(ctx, roomID, fromAgentID, toAgentID, false)
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		s.undoReassign(ctx, roomID, fromAgentID, toAgentID, true)
+		return fmt.Errorf("Error committing assignment: %w", err)
+	}
+
+	return nil
+}
+
+// undoReassign gives the room back to the agent it was taken from, and the
+// slot too when the counters were moved.
+func (s *Service) undoReassign(ctx context.Context, roomID string, fromAgentID, toAgentID int, moved bool) {
+	undoCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), assignFallbackTimeout)
+	defer cancel()
+
+	if _, err := s.Qiscus.AssignAgent(undoCtx, roomID, fromAgentID); err != nil {
+		log.Printf("Error giving room %s back to agent %d: %v", roomID, fromAgentID, err)
+	}
+	if err := s.Qiscus.RemoveAgent(undoCtx, roomID, toAgentID); err != nil {
+		log.Printf("Error removing agent %d from room %s: %v", toAgentID, roomID, err)
+	}
+
+	if !moved {
+		return
+	}
+
+	from, to := strconv.Itoa(fromAgentID), strconv.Itoa(toAgentID)
+	toCount, fromCount, err := s.Agents.MoveRoom(undoCtx, roomID, to, from)
+	if err != nil {
+		log.Printf("Error moving room %s back to agent %d: %v", roomID, fromAgentID, err)
+		return
+	}
+	s.PublishCustomerCount(undoCtx, to, toCount)
+	s.PublishCustomerCount(undoCtx, from, fromCount)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+func TestFirstResponseAfterReopen(t *testing.T) {
+	ctx := context.Background()
+	s, agents, rooms, events := newTestService(t)
+
+	agents.AddAgent(ctx, "1", []string{"ann@example.com"})
+	agents.SetCustomerCount(ctx, "1", 0)
+
+	// The agent answers the first session, which is then resolved
+	agents.AssignRoom(ctx, "room-1", 10, "1")
+	if err := s.RecordAgentResponse(ctx, "room-1", "ann@example.com"); err != nil {
+		t.Fatalf("RecordAgentResponse: %v", err)
+	}
+	if _, err := s.ReleaseRoomAgent(ctx, "room-1", 10, 0); err != nil {
+		t.Fatalf("ReleaseRoomAgent: %v", err)
+	}
+
+	// The re-opened room goes to the same agent
+	time.Sleep(2 * time.Millisecond)
+	agents.AssignRoom(ctx, "room-1", 11, "1")
+	assignedAt := time.Now().UnixMilli()
+
+	if _, err := rooms.FirstResponseAt(ctx, "room-1", 11); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("re-opened session has a first response: err = %v", err)
+	}
+
+	if err := s.RecordAgentResponse(ctx, "room-1", "ann@example.com"); err != nil {
+		t.Fatalf("RecordAgentResponse: %v", err)
+	}
+	respondedAt, err := rooms.FirstResponseAt(ctx, "room-1", 11)
+	if err != nil {
+		t.Fatalf("FirstResponseAt: %v", err)
+	}
+	if respondedAt.UnixMilli() < assignedAt {
+		t.Errorf("first response of the re-opened session at %d, before its assignment at %d", respondedAt.UnixMilli(), assignedAt)
+	}
+
+	// The check of the new session sees the answer and does not escalate
+	payload, _ := json.Marshal(ChatFirstResponseCheckPayload{RoomID: "room-1", ServiceID: 11, Source: "wa", AgentID: 1, AssignedAt: assignedAt})
+	if err := s.HandleChatFirstResponseCheckTask(ctx, asynq.NewTask(TypeChatFirstResponseCheck, payload)); err != nil {
+		t.Fatalf("HandleChatFirstResponseCheckTask: %v", err)
+	}
+	for _, typ := range events.types() {
+		if typ == EventRoomEscalated || typ == EventRoomReassigned {
+			t.Errorf("answered room got %s", typ)
+		}
+	}
+}
+
+// TestReassignUndoneWhenNotRecorded fails the history of a transfer and
+// checks the room stays with its agent, so a retry moves it again.
+func TestReassignUndoneWhenNotRecorded(t *testing.T) {
+	for _, step := range []string{"CreateAssignment", "Commit"} {
+		t.Run(step, func(t *testing.T) {
+			ctx := context.Background()
+			s, agents, _, _ := newTestService(t)
+
+			f, q := newTestQiscus(t, fakeAgentConfig{ID: 1, Online: true}, fakeAgentConfig{ID: 2, Online: true})
+			s.Qiscus = q
+			chats := &memChats{failAt: step}
+			s.Chats = chats
+
+			room := f.NewRoom("wa", "Jane", "jane@example.com")
+			if _, err := q.AssignAgent(ctx, room.ID, 1); err != nil {
+				t.Fatalf("AssignAgent: %v", err)
+			}
+			agents.AddAgent(ctx, "1", nil)
+			agents.AddAgent(ctx, "2", nil)
+			agents.SetCustomerCount(ctx, "1", 0)
+			agents.SetCustomerCount(ctx, "2", 0)
+			agents.AssignRoom(ctx, room.ID, room.ServiceID, "1")
+
+			err := s.ReassignRoom(ctx, room.ID, 1, 2, AssignmentKindTransfer, "test", "admin", nil)
+			if err == nil {
+				t.Fatal("ReassignRoom succeeded")
+			}
+
+			if got := fakeRoom(t, f, room.ID).AgentID; got != 1 {
+				t.Errorf("agent of the room = %d, want 1", got)
+			}
+			if id, err := agents.RoomAgent(ctx, room.ID); err != nil || id != "1" {
+				t.Errorf("room agent = %q, %v, want 1", id, err)
+			}
+			if count, _ := agents.CustomerCount(ctx, "1"); count != 1 {
+				t.Errorf("customer count of agent 1 = %d, want 1", count)
+			}
+			if count, _ := agents.CustomerCount(ctx, "2"); count != 0 {
+				t.Errorf("customer count of agent 2 = %d, want 0", count)
+			}
+			if chats.committed != 0 {
+				t.Errorf("%d transactions committed", chats.committed)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	EventRoomEnqueued         = "room_enqueued"
+	EventRoomParked           = "room_parked"
+	EventRoomAssigned         = "room_assigned"
+	EventRoomResolved         = "room_resolved"
+	EventRoomAbandoned        = "room_abandoned"
+	EventRoomEscalated        = "room_escalated"
+	EventRoomReassigned       = "room_reassigned"
+	EventAgentOnline          = "agent_online"
+	EventAgentOffline         = "agent_offline"
+	EventAgentDraining        = "agent_draining"
+	EventAgentDrained         = "agent_drained"
+	EventCustomerCountChanged = "customer_count_changed"
+)
+
+type Event struct {
+	Type          string    `json:"type"`
+	RoomID        string    `json:"room_id,omitempty"`
+	AgentID       string    `json:"agent_id,omitempty"`
+	PreviousAgent string    `json:"previous_agent_id,omitempty"`
+	CustomerCount *int      `json:"customer_count,omitempty"`
+	WaitSeconds   float64   `json:"wait_seconds,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// PublishEvent broadcasts the event to every subscribed dashboard. Failing
+// to publish never fails the caller.
+func (s *Service) PublishEvent(ctx context.Context, ev Event) {
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+
+	if err := s.Events.Publish(ctx, ev); err != nil {
+		log.Printf("Error publishing event %s: %v", ev.Type, err)
+	}
+}
+
+func (s *Service) PublishCustomerCount(ctx context.Context, agentID string, count int) {
+	s.PublishEvent(ctx, Event{
+		Type:          EventCustomerCountChanged,
+		AgentID:       agentID,
+		CustomerCount: &count,
+	})
+}
+
+func (s *Service) HandleEventStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, err := s.Events.Subscribe(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to subscribe to events: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			payload, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("Skipping event %s: %v", ev.Type, err)
+				continue
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, payload)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
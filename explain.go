@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Reasons an agent was chosen or passed over
+const (
+	CandidateChosen       = "chosen"
+	CandidateEligible     = "eligible"
+	CandidateOffline      = "offline"
+	CandidateAtCapacity   = "at_capacity"
+	CandidateUnknownCount = "unknown_count"
+	CandidateDraining     = "draining"
+	CandidateOffShift     = "off_shift"
+	CandidateExcluded     = "excluded"
+	// CandidateWrongChannel is an agent Qiscus did not list as available
+	// for the room, usually because they do not serve its channel.
+	CandidateWrongChannel = "wrong_channel"
+)
+
+// Where the chosen agent came from
+const (
+	SourceCache          = "cache"
+	SourceQiscus         = "qiscus"
+	SourceWebhook        = "webhook"
+	SourceQiscusAllocate = "qiscus_allocate"
+)
+
+// Candidate is one agent considered for a room. Rank orders the eligible
+// agents, 1 is the chosen one, rejected agents have none.
+type Candidate struct {
+	AgentID       string `json:"agent_id"`
+	CustomerCount *int   `json:"customer_count"`
+	Reason        string `json:"reason"`
+	Rank          int    `json:"rank,omitempty"`
+}
+
+// Explanation tells why a room got its agent. It is returned by the dry run
+// and saved with every assignment the allocator makes.
+type Explanation struct {
+	Backend          string      `json:"backend"`
+	Source           string      `json:"source,omitempty"`
+	MaxCustomerCount int         `json:"max_customer_count"`
+	AgentID          string      `json:"agent_id,omitempty"`
+	Candidates       []Candidate `json:"candidates"`
+	Notes            []string    `json:"notes,omitempty"`
+}
+
+func (e *Explanation) note(format string, args ...any) {
+	e.Notes = append(e.Notes, fmt.Sprintf(format, args...))
+}
+
+// rank orders the eligible candidates the way the agent is picked: the
+// fewest customers first and, between equal counts, the agent seen last.
+// Rejected candidates follow in the order they were seen.
+func (e *Explanation) rank() {
+	order := make([]int, len(e.Candidates))
+	for i := range order {
+		order[i] = i
+	}
+
+	eligible := func(c Candidate) bool { return c.Reason == CandidateEligible || c.Reason == CandidateChosen }
+	sort.SliceStable(order, func(a, b int) bool {
+		ca, cb := e.Candidates[order[a]], e.Candidates[order[b]]
+		if eligible(ca) != eligible(cb) {
+			return eligible(ca)
+		}
+		if !eligible(ca) {
+			return false
+		}
+		if *ca.CustomerCount != *cb.CustomerCount {
+			return *ca.CustomerCount < *cb.CustomerCount
+		}
+		return order[a] > order[b]
+	})
+
+	ranked := make([]Candidate, 0, len(e.Candidates))
+	for i, idx := range order {
+		c := e.Candidates[idx]
+		c.Rank = 0
+		if eligible(c) {
+			c.Reason = CandidateEligible
+			c.Rank = i + 1
+		}
+		ranked = append(ranked, c)
+	}
+
+	e.AgentID = ""
+	if len(ranked) > 0 && ranked[0].Rank == 1 {
+		ranked[0].Reason = CandidateChosen
+		e.AgentID = ranked[0].AgentID
+	}
+	e.Candidates = ranked
+}
+
+// explainAvailableAgent is the selection of FindAvailableAgent. With cache
+// false it is a dry run that does not write what Qiscus answers into the
+// agent cache.
+func (s *Service) explainAvailableAgent(ctx context.Context, roomID string, maxCustomerCount int, cache bool, exclude ...string) (*Explanation, error) {
+	exp := &Explanation{
+		Backend:          s.conf().Allocation.Backend,
+		Source:           SourceCache,
+		MaxCustomerCount: maxCustomerCount,
+		Candidates:       []Candidate{},
+	}
+
+	agentIDs, err := s.Agents.AgentIDs(ctx)
+	if err != nil {
+		log.Printf("Error getting agents %v", err)
+		return exp, err
+	}
+
+	onShift, err := s.onShiftAgents(ctx)
+	if err != nil {
+		log.Printf("Error getting shifts %v", err)
+		return exp, err
+	}
+
+	draining, err := s.Agents.DrainingAgents(ctx)
+	if err != nil {
+		log.Printf("Error getting draining agents %v", err)
+		return exp, err
+	}
+
+	// rejection is the reason an agent cannot take any room right now
+	rejection := func(id string) string {
+		if _, ok := draining[id]; ok {
+			return CandidateDraining
+		}
+		if isExcluded(exclude, id) {
+			return CandidateExcluded
+		}
+		if !isOnShift(onShift, id) {
+			return CandidateOffShift
+		}
+		return ""
+	}
+
+	foundUnknownCustomerKey := false
+	for _, id := range agentIDs {
+		if reason := rejection(id); reason != "" {
+			exp.Candidates = append(exp.Candidates, Candidate{AgentID: id, Reason: reason})
+			continue
+		}
+
+		isOnline, err := s.Agents.IsOnline(ctx, id)
+		if err != nil {
+			log.Printf("Error getting online status of agent %s err: %v", id, err)
+			return exp, fmt.Errorf("Could not get is_online")
+		}
+
+		if !isOnline {
+			exp.Candidates = append(exp.Candidates, Candidate{AgentID: id, Reason: CandidateOffline})
+			continue
+		}
+
+		customerCount, err := s.Agents.CustomerCount(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				foundUnknownCustomerKey = true
+				exp.Candidates = append(exp.Candidates, Candidate{AgentID: id, Reason: CandidateUnknownCount})
+				continue
+			}
+			log.Printf("Error getting current customer count of agent %s err: %v", id, err)
+			return exp, fmt.Errorf("Could not get customer count")
+		}
+
+		if customerCount == -1 {
+			foundUnknownCustomerKey = true
+			exp.Candidates = append(exp.Candidates, Candidate{AgentID: id, Reason: CandidateUnknownCount})
+			continue
+		}
+
+		reason := CandidateEligible
+		if customerCount >= maxCustomerCount {
+			reason = CandidateAtCapacity
+		}
+		exp.Candidates = append(exp.Candidates, Candidate{AgentID: id, CustomerCount: &customerCount, Reason: reason})
+	}
+
+	exp.rank()
+	if exp.AgentID != "" || !foundUnknownCustomerKey {
+		return exp, nil
+	}
+
+	// Some counts are unknown, ask Qiscus for the agents of the room
+	availableAgents, err := s.Qiscus.GetAvailableAgents(ctx, roomID)
+	if err != nil {
+		log.Printf("Error getting available agents: %v", err)
+		exp.note("Qiscus available agents failed: %v", err)
+		return exp, nil
+	}
+
+	cached := exp.Candidates
+	exp.Source = SourceQiscus
+	exp.Candidates = []Candidate{}
+
+	listed := make(map[string]struct{}, len(availableAgents.Data.Agents))
+	for _, agent := range availableAgents.Data.Agents {
+		id := strconv.Itoa(agent.ID)
+		listed[id] = struct{}{}
+
+		if cache {
+			if err := s.cacheAvailableAgent(ctx, id, agent.CurrentCustomerCount); err != nil {
+				exp.note("Caching agent %s failed: %v", id, err)
+				return exp, nil
+			}
+		}
+
+		if reason := rejection(id); reason != "" {
+			exp.Candidates = append(exp.Candidates, Candidate{AgentID: id, Reason: reason})
+			continue
+		}
+
+		customerCount := agent.CurrentCustomerCount
+		reason := CandidateEligible
+		if customerCount >= maxCustomerCount {
+			reason = CandidateAtCapacity
+		}
+		exp.Candidates = append(exp.Candidates, Candidate{AgentID: id, CustomerCount: &customerCount, Reason: reason})
+	}
+
+	for _, c := range cached {
+		if _, ok := listed[c.AgentID]; ok {
+			continue
+		}
+		if c.Reason == CandidateUnknownCount || c.Reason == CandidateAtCapacity {
+			c.Reason = CandidateWrongChannel
+		}
+		exp.Candidates = append(exp.Candidates, c)
+	}
+
+	exp.rank()
+	return exp, nil
+}
+
+// cacheAvailableAgent stores what Qiscus says about an available agent.
+func (s *Service) cacheAvailableAgent(ctx context.Context, agentID string, customerCount int) error {
+	_, err := s.Agents.SetOnline(ctx, agentID, true)
+	if err != nil {
+		log.Printf("Error set online status of agent %s err: %v", agentID, err)
+		return err
+	}
+
+	err = s.Agents.SetCustomerCount(ctx, agentID, customerCount)
+	if err != nil {
+		log.Printf("Error set customer count of agent %s err: %v", agentID, err)
+		return err
+	}
+
+	return nil
+}
+
+// ExplainAllocation runs the selection of the configured backend for the
+// room without assigning or caching anything.
+func (s *Service) ExplainAllocation(ctx context.Context, wimr *WebhookIncomingMessageRequest) (*Explanation, error) {
+	backend := s.conf().Allocation.Backend
+	maxCustomerCount := int(s.conf().WebhookConfig.MaxCurrentCustomer)
+
+	var exp *Explanation
+	var err error
+
+	switch backend {
+	case BackendQiscusCandidate:
+		exp = candidateExplanation(wimr)
+	case BackendQiscusAllocate:
+		exp = &Explanation{Source: SourceQiscusAllocate, Candidates: []Candidate{}}
+		exp.note("Qiscus allocates the agent itself, it cannot be dry run")
+	default:
+		exp, err = s.explainAvailableAgent(ctx, wimr.RoomID, maxCustomerCount, false)
+		if err != nil {
+			return nil, err
+		}
+		if exp.AgentID == "" && backend == BackendHybrid {
+			exp.note("No agent with our rules, Qiscus would allocate one")
+		}
+	}
+	exp.Backend = backend
+	exp.MaxCustomerCount = maxCustomerCount
+
+	if !s.IsChannelOpen(wimr.Source, time.Now()) {
+		exp.note("Channel %s is closed, the room would be parked until it opens", wimr.Source)
+	}
+
+	return exp, nil
+}
+
+func candidateExplanation(wimr *WebhookIncomingMessageRequest) *Explanation {
+	exp := &Explanation{Source: SourceWebhook, Candidates: []Candidate{}}
+	if wimr.CandidateAgent.ID == 0 {
+		exp.note("The webhook has no candidate agent")
+		return exp
+	}
+
+	exp.AgentID = strconv.Itoa(wimr.CandidateAgent.ID)
+	exp.Candidates = append(exp.Candidates, Candidate{AgentID: exp.AgentID, Reason: CandidateChosen, Rank: 1})
+	return exp
+}
+
+// HandleExplain is the dry run of the allocation for an allocate webhook
+// payload.
+func (s *Service) HandleExplain(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var data WebhookIncomingMessageRequest
+	if err := json.Unmarshal(body, &data); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	exp, err := s.ExplainAllocation(r.Context(), &data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to explain allocation: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, exp)
+}
@@ -0,0 +1,1048 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// FakeQiscus is an in memory stand-in for the Qiscus Omnichannel API. It
+// serves the endpoints qiscusHTTP calls, sends the allocate, resolve and new
+// message webhooks back at the service and plays scripted agents. It is an
+// http.Handler, so tests can serve it with httptest.NewServer.
+//
+// Rooms resolved through the API do not fire the resolve webhook, only rooms
+// resolved by an agent do, the service releases its own resolves itself.
+type FakeQiscus struct {
+	AppID     string
+	SecretKey string
+	Email     string
+	Password  string
+	// WebhookBaseUrl is where the webhooks go until the service sets its
+	// own urls, usually webhook.base_url
+	WebhookBaseUrl string
+	// OnAssign is called with every assignment while the fake is locked, it
+	// must not call back into the fake
+	OnAssign func(room FakeRoom)
+
+	router http.Handler
+	client *http.Client
+
+	mu            sync.Mutex
+	token         string
+	agents        map[int]*fakeAgent
+	rooms         map[string]*FakeRoom
+	botMessages   []FakeBotMessage
+	incomingUrl   string
+	resolvedUrl   string
+	nextRoomID    int
+	nextServiceID int
+	nextCommentID int
+}
+
+type fakeAgent struct {
+	fakeAgentConfig
+	rooms map[string]struct{}
+}
+
+// FakeRoom is a customer room of the fake, AgentID is 0 until assigned.
+type FakeRoom struct {
+	ID            string    `json:"id"`
+	ServiceID     int       `json:"service_id"`
+	Source        string    `json:"source"`
+	Name          string    `json:"name"`
+	Email         string    `json:"email"`
+	AgentID       int       `json:"agent_id"`
+	IsResolved    bool      `json:"is_resolved"`
+	LastCommentID string    `json:"last_comment_id"`
+	Tags          []string  `json:"tags,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type FakeBotMessage struct {
+	RoomID  string         `json:"room_id"`
+	Type    string         `json:"type"`
+	Message string         `json:"message"`
+	Extras  map[string]any `json:"extras,omitempty"`
+	SentAt  time.Time      `json:"sent_at"`
+}
+
+// FakeAgent is the state of an agent as /fake/state shows it.
+type FakeAgent struct {
+	ID                   int      `json:"id"`
+	Name                 string   `json:"name"`
+	Email                string   `json:"email"`
+	Online               bool     `json:"online"`
+	CurrentCustomerCount int      `json:"current_customer_count"`
+	RoomIDs              []string `json:"room_ids"`
+}
+
+type FakeState struct {
+	Agents      []FakeAgent      `json:"agents"`
+	Rooms       []FakeRoom       `json:"rooms"`
+	BotMessages []FakeBotMessage `json:"bot_messages"`
+}
+
+// NewFakeQiscus returns a fake that accepts the given credentials and knows
+// the given agents. An empty appID accepts any app.
+func NewFakeQiscus(qc qiscusConfig, webhookBaseUrl string, agents []fakeAgentConfig) *FakeQiscus {
+	f := &FakeQiscus{
+		AppID:          qc.AppID,
+		SecretKey:      qc.SecretKey,
+		Email:          qc.Email,
+		Password:       qc.Password,
+		WebhookBaseUrl: webhookBaseUrl,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		agents:         make(map[int]*fakeAgent),
+		rooms:          make(map[string]*FakeRoom),
+		nextRoomID:     1000,
+		nextServiceID:  1,
+		nextCommentID:  1,
+	}
+
+	for _, a := range agents {
+		f.AddAgent(a)
+	}
+
+	allAgentsPath, _, _ := strings.Cut(GET_ALL_AGENT_PATH, "?")
+
+	r := chi.NewRouter()
+	r.Use(middleware.Logger)
+	r.Post(AUTH_PATH, f.handleAuth)
+	r.Get(GET_WEBHOOK_CONFIG_PATH, f.handleGetWebhookConfig)
+
+	r.Group(func(r chi.Router) {
+		r.Use(f.requireApp)
+		r.Get(allAgentsPath, f.handleGetAllAgents)
+		r.Get(GET_AVAILABLE_AGENT_PATH, f.handleGetAvailableAgents)
+		r.Post(ASSIGN_AGENT_PATH, f.handleAssignAgent)
+		r.Post(REMOVE_AGENT_PATH, f.handleRemoveAgent)
+		r.Post(ALLOCATE_ASSIGN_AGENT_PATH, f.handleAllocateAssignAgent)
+		r.Post(MARK_AS_RESOLVED_PATH, f.handleMarkAsResolved)
+		r.Post(SET_WEBHOOK_INCOMING_MESSAGE, f.handleSetWebhook(&f.incomingUrl))
+		r.Post(SET_WEBHOOK_MARK_AS_RESOLVED, f.handleSetWebhook(&f.resolvedUrl))
+		r.Post(fmt.Sprintf(SEND_BOT_MESSAGE_PATH, "{app_id}"), f.handleSendBotMessage)
+		r.Get(fmt.Sprintf(GET_ROOM_PATH, "{room_id}"), f.handleGetRoom)
+		r.Post(LIST_ROOMS_PATH, f.handleListRooms)
+		r.Post(ADD_ROOM_TAG_PATH, f.handleAddRoomTag)
+	})
+
+	// Control endpoints to play the customers and agents by hand
+	r.Route("/fake", func(r chi.Router) {
+		r.Get("/state", f.handleState)
+		r.Post("/rooms", f.handleNewRoom)
+		r.Post("/rooms/{room_id}/messages", f.handleRoomMessage)
+		r.Post("/rooms/{room_id}/resolve", f.handleAgentResolve)
+		r.Post("/agents/{agent_id}/online", f.handleAgentOnline(true))
+		r.Post("/agents/{agent_id}/offline", f.handleAgentOnline(false))
+	})
+
+	f.router = r
+	return f
+}
+
+func (f *FakeQiscus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.router.ServeHTTP(w, r)
+}
+
+// AddAgent adds the agent or replaces the one with the same id, keeping its
+// rooms.
+func (f *FakeQiscus) AddAgent(a fakeAgentConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if a.Name == "" {
+		a.Name = fmt.Sprintf("Agent %d", a.ID)
+	}
+	if a.Email == "" {
+		a.Email = fmt.Sprintf("agent%d@fake.qiscus", a.ID)
+	}
+
+	rooms := make(map[string]struct{})
+	if old, ok := f.agents[a.ID]; ok {
+		rooms = old.rooms
+	}
+	f.agents[a.ID] = &fakeAgent{fakeAgentConfig: a, rooms: rooms}
+}
+
+// Play runs the schedules of the agents until ctx is done.
+func (f *FakeQiscus) Play(ctx context.Context) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, a := range f.agents {
+		for _, st := range a.Schedule {
+			id, online := a.ID, st.Online
+			timer := time.AfterFunc(st.After, func() {
+				if err := f.SetOnline(id, online); err != nil {
+					log.Printf("Fake agent %d: %v", id, err)
+				}
+			})
+			context.AfterFunc(ctx, func() { timer.Stop() })
+		}
+	}
+}
+
+// SetOnline changes the availability of the agent like the agent's toggle
+// in the Qiscus dashboard.
+func (f *FakeQiscus) SetOnline(agentID int, online bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	a, ok := f.agents[agentID]
+	if !ok {
+		return fmt.Errorf("unknown agent %d", agentID)
+	}
+	a.Online = online
+
+	log.Printf("Fake agent %d online: %t", agentID, online)
+	return nil
+}
+
+// NewRoom opens a room for a new customer and sends the allocate webhook.
+func (f *FakeQiscus) NewRoom(source, name, email string) FakeRoom {
+	f.mu.Lock()
+
+	room := &FakeRoom{
+		ID:            strconv.Itoa(f.nextRoomID),
+		ServiceID:     f.nextServiceID,
+		Source:        source,
+		Name:          name,
+		Email:         email,
+		LastCommentID: f.newCommentID(),
+		CreatedAt:     time.Now(),
+	}
+	f.nextRoomID++
+	f.nextServiceID++
+	f.rooms[room.ID] = room
+
+	wimr := f.allocatePayload(room)
+	webhookUrl := f.webhookUrl(f.incomingUrl, WEBHOOK_INCOMING_MESSAGE_PATH)
+	res := *room
+	f.mu.Unlock()
+
+	log.Printf("Fake room %s opened by %s", res.ID, email)
+	f.sendWebhook(webhookUrl, wimr)
+
+	return res
+}
+
+// allocatePayload is the allocate webhook of the room's current session.
+func (f *FakeQiscus) allocatePayload(room *FakeRoom) WebhookIncomingMessageRequest {
+	var wimr WebhookIncomingMessageRequest
+	wimr.AppID = f.AppID
+	wimr.Source = room.Source
+	wimr.Name = room.Name
+	wimr.Email = room.Email
+	wimr.RoomID = room.ID
+	wimr.LatestService.ID = room.ServiceID
+	wimr.LatestService.RoomID = room.ID
+	wimr.LatestService.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	wimr.LatestService.FirstCommentID = room.LastCommentID
+	wimr.LatestService.LastCommentID = room.LastCommentID
+	if a := f.leastBusyAgent(); a != nil {
+		wimr.CandidateAgent.ID = a.ID
+		wimr.CandidateAgent.Name = a.Name
+		wimr.CandidateAgent.Email = a.Email
+		wimr.CandidateAgent.IsAvailable = true
+	}
+
+	return wimr
+}
+
+// SendMessage posts a message into the room from the customer, or from the
+// agent serving it when fromAgent is set, and sends the new message webhook.
+// A customer writing into a resolved room re-opens it with a new session,
+// which sends the allocate webhook again.
+func (f *FakeQiscus) SendMessage(roomID string, fromAgent bool, text string) error {
+	f.mu.Lock()
+
+	room, ok := f.rooms[roomID]
+	if !ok {
+		f.mu.Unlock()
+		return ErrNotFound
+	}
+
+	reopen := room.IsResolved
+	if reopen {
+		if fromAgent {
+			f.mu.Unlock()
+			return fmt.Errorf("room %s is resolved", roomID)
+		}
+
+		room.ServiceID = f.nextServiceID
+		room.IsResolved = false
+		room.AgentID = 0
+		f.nextServiceID++
+	}
+
+	var reopened *WebhookIncomingMessageRequest
+	var data WebhookNewMessageRequest
+	data.Type = "post_comment_mobile"
+	data.Payload.From.Email = room.Email
+	data.Payload.From.Name = room.Name
+	if fromAgent {
+		a, ok := f.agents[room.AgentID]
+		if !ok {
+			f.mu.Unlock()
+			return fmt.Errorf("room %s has no agent", roomID)
+		}
+		data.Payload.From.ID = flexString(strconv.Itoa(a.ID))
+		data.Payload.From.Email = a.Email
+		data.Payload.From.Name = a.Name
+	}
+
+	room.LastCommentID = f.newCommentID()
+	data.Payload.Room.ID = flexString(room.ID)
+	data.Payload.Room.Name = room.Name
+	data.Payload.Message.ID = flexString(room.LastCommentID)
+	data.Payload.Message.Type = "text"
+	data.Payload.Message.Text = text
+	data.Payload.Message.Timestamp = time.Now().UTC().Format(time.RFC3339)
+
+	if reopen {
+		wimr := f.allocatePayload(room)
+		reopened = &wimr
+	}
+
+	webhookUrl := f.webhookUrl("", WEBHOOK_NEW_MESSAGE_PATH)
+	allocateUrl := f.webhookUrl(f.incomingUrl, WEBHOOK_INCOMING_MESSAGE_PATH)
+	f.mu.Unlock()
+
+	f.sendWebhook(webhookUrl, data)
+	if reopened != nil {
+		log.Printf("Fake room %s re-opened with session %d", roomID, reopened.LatestService.ID)
+		f.sendWebhook(allocateUrl, *reopened)
+	}
+	return nil
+}
+
+// ResolveRoom resolves the room as the agent serving it and sends the
+// resolve webhook.
+func (f *FakeQiscus) ResolveRoom(roomID string) error {
+	f.mu.Lock()
+
+	room, ok := f.rooms[roomID]
+	if !ok {
+		f.mu.Unlock()
+		return ErrNotFound
+	}
+	if room.IsResolved {
+		f.mu.Unlock()
+		return nil
+	}
+
+	data := f.resolvedWebhook(room)
+	f.resolve(room)
+	webhookUrl := f.webhookUrl(f.resolvedUrl, WEBHOOK_MARK_AS_RESOLVED_PATH)
+	f.mu.Unlock()
+
+	log.Printf("Fake room %s resolved by agent %d", roomID, data.ResolvedBy.ID)
+	f.sendWebhook(webhookUrl, data)
+	return nil
+}
+
+// State returns a snapshot of the agents, rooms and bot messages.
+func (f *FakeQiscus) State() FakeState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state := FakeState{
+		Agents:      []FakeAgent{},
+		Rooms:       []FakeRoom{},
+		BotMessages: append([]FakeBotMessage{}, f.botMessages...),
+	}
+
+	for _, a := range f.agents {
+		roomIDs := []string{}
+		for id := range a.rooms {
+			roomIDs = append(roomIDs, id)
+		}
+		sort.Strings(roomIDs)
+
+		state.Agents = append(state.Agents, FakeAgent{
+			ID:                   a.ID,
+			Name:                 a.Name,
+			Email:                a.Email,
+			Online:               a.Online,
+			CurrentCustomerCount: len(a.rooms),
+			RoomIDs:              roomIDs,
+		})
+	}
+	sort.Slice(state.Agents, func(i, j int) bool { return state.Agents[i].ID < state.Agents[j].ID })
+
+	for _, r := range f.rooms {
+		room := *r
+		room.Tags = slices.Clone(r.Tags)
+		state.Rooms = append(state.Rooms, room)
+	}
+	sort.Slice(state.Rooms, func(i, j int) bool { return state.Rooms[i].ID < state.Rooms[j].ID })
+
+	return state
+}
+
+// The helpers below expect f.mu to be held.
+
+func (f *FakeQiscus) newCommentID() string {
+	id := strconv.Itoa(f.nextCommentID)
+	f.nextCommentID++
+	return id
+}
+
+func (f *FakeQiscus) leastBusyAgent() *fakeAgent {
+	var best *fakeAgent
+	for _, a := range f.agents {
+		if !a.Online {
+			continue
+		}
+		if best == nil || len(a.rooms) < len(best.rooms) || (len(a.rooms) == len(best.rooms) && a.ID < best.ID) {
+			best = a
+		}
+	}
+	return best
+}
+
+// assign puts the agent into the room and starts its script: the first
+// reply and the resolve after the handle time.
+func (f *FakeQiscus) assign(room *FakeRoom, a *fakeAgent) {
+	if prev, ok := f.agents[room.AgentID]; ok {
+		delete(prev.rooms, room.ID)
+	}
+	room.AgentID = a.ID
+	a.rooms[room.ID] = struct{}{}
+
+	log.Printf("Fake room %s assigned to agent %d", room.ID, a.ID)
+	if f.OnAssign != nil {
+		f.OnAssign(*room)
+	}
+
+	roomID, agentID := room.ID, a.ID
+	if a.FirstReply > 0 {
+		time.AfterFunc(a.FirstReply, func() {
+			if f.servedBy(roomID, agentID) {
+				f.SendMessage(roomID, true, "Hi, how can I help?")
+			}
+		})
+	}
+	if a.HandleTime > 0 {
+		time.AfterFunc(a.HandleTime, func() {
+			if f.servedBy(roomID, agentID) {
+				f.ResolveRoom(roomID)
+			}
+		})
+	}
+}
+
+// resolvedWebhook is the resolve webhook of the room, resolved by the agent
+// serving it. f.mu must be held.
+func (f *FakeQiscus) resolvedWebhook(room *FakeRoom) WebhookMarkAsResolvedRequest {
+	var data WebhookMarkAsResolvedRequest
+	data.Service.ID = room.ServiceID
+	data.Service.RoomID = room.ID
+	data.Service.IsResolved = true
+	data.Service.LastCommentID = room.LastCommentID
+	data.Service.Source = room.Source
+	data.Customer.UserID = room.Email
+	if a, ok := f.agents[room.AgentID]; ok {
+		data.ResolvedBy.ID = a.ID
+		data.ResolvedBy.Email = a.Email
+		data.ResolvedBy.Name = a.Name
+		data.ResolvedBy.Type = "agent"
+		data.ResolvedBy.IsAvailable = a.Online
+	}
+
+	return data
+}
+
+func (f *FakeQiscus) resolve(room *FakeRoom) {
+	room.IsResolved = true
+	if a, ok := f.agents[room.AgentID]; ok {
+		delete(a.rooms, room.ID)
+	}
+}
+
+func (f *FakeQiscus) webhookUrl(set, path string) string {
+	if set != "" {
+		return set
+	}
+	return f.WebhookBaseUrl + path
+}
+
+func (f *FakeQiscus) servedBy(roomID string, agentID int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	room, ok := f.rooms[roomID]
+	return ok && !room.IsResolved && room.AgentID == agentID
+}
+
+func (f *FakeQiscus) sendWebhook(url string, payload any) {
+	// Without a base url there is nobody to tell
+	if !strings.HasPrefix(url, "http") {
+		return
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Fake webhook %s: %v", url, err)
+		return
+	}
+
+	go func() {
+		res, err := f.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Fake webhook %s: %v", url, err)
+			return
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			log.Printf("Fake webhook %s: status code %d", url, res.StatusCode)
+		}
+	}()
+}
+
+func (f *FakeQiscus) requireApp(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appID := r.Header.Get("Qiscus-App-Id")
+		if f.AppID != "" && (appID != f.AppID || r.Header.Get("Qiscus-Secret-Key") != f.SecretKey) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *FakeQiscus) handleAuth(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	if f.Email != "" && (r.PostForm.Get("email") != f.Email || r.PostForm.Get("password") != f.Password) {
+		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+		return
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+
+	f.mu.Lock()
+	f.token = hex.EncodeToString(buf)
+	token := f.token
+	f.mu.Unlock()
+
+	var res LoginResponse
+	res.Data.User.Email = r.PostForm.Get("email")
+	res.Data.User.AuthenticationToken = token
+	res.Data.User.App.AppCode = f.AppID
+	res.Data.Details.App.AppCode = f.AppID
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (f *FakeQiscus) handleGetWebhookConfig(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.token == "" || r.Header.Get("Authorization") != f.token {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var res WebhookConfigResponse
+	res.Status = http.StatusOK
+	res.Data.WebhookConfigs = res.Data.WebhookConfigs[:0:0]
+	for i, wc := range []struct{ typ, url string }{
+		{"agent_allocation", f.incomingUrl},
+		{"mark_as_resolved", f.resolvedUrl},
+	} {
+		if wc.url == "" {
+			continue
+		}
+		res.Data.WebhookConfigs = append(res.Data.WebhookConfigs, struct {
+			CreatedAt string `json:"created_at"`
+			ID        int    `json:"id"`
+			IsActive  bool   `json:"is_active"`
+			Type      string `json:"type"`
+			UpdatedAt string `json:"updated_at"`
+			URL       string `json:"url"`
+		}{ID: i + 1, IsActive: true, Type: wc.typ, URL: wc.url})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (f *FakeQiscus) handleSetWebhook(target *string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		*target = r.PostForm.Get("webhook_url")
+		if r.PostForm.Get("is_webhook_enabled") == "false" {
+			*target = ""
+		}
+
+		var res SetWebHookResponse
+		res.Data.AppCode = f.AppID
+		res.Data.AllocateAgentWebhookURL = f.incomingUrl
+		res.Data.IsAllocateAgentWebhookEnabled = f.incomingUrl != ""
+		res.Data.MarkAsResolvedWebhookURL = f.resolvedUrl
+		res.Data.IsMarkAsResolvedWebhookEnabled = f.resolvedUrl != ""
+		res.Data.IsActive = true
+		f.mu.Unlock()
+
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func (f *FakeQiscus) agentOf(a *fakeAgent) Agent {
+	return Agent{
+		ID:                   a.ID,
+		Name:                 a.Name,
+		Email:                a.Email,
+		SdkEmail:             a.Email,
+		IsAvailable:          a.Online,
+		CurrentCustomerCount: len(a.rooms),
+		Type:                 2,
+		TypeAsString:         "agent",
+	}
+}
+
+func (f *FakeQiscus) sortedAgents() []*fakeAgent {
+	agents := make([]*fakeAgent, 0, len(f.agents))
+	for _, a := range f.agents {
+		agents = append(agents, a)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
+
+func (f *FakeQiscus) handleGetAllAgents(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var res GetAllAgentResponse
+	res.Status = http.StatusOK
+	res.Data.Agents = []Agent{}
+	for _, a := range f.sortedAgents() {
+		res.Data.Agents = append(res.Data.Agents, f.agentOf(a))
+	}
+	res.Data.Meta.PerPage = len(res.Data.Agents)
+	res.Data.Meta.TotalCount = len(res.Data.Agents)
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (f *FakeQiscus) handleGetAvailableAgents(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.rooms[r.URL.Query().Get("room_id")]; !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	var res GetAvailableAgentResponse
+	res.Status = http.StatusOK
+	res.Data.Agents = []AvailableAgent{}
+	for _, a := range f.sortedAgents() {
+		if a.Online {
+			res.Data.Agents = append(res.Data.Agents, AvailableAgent(f.agentOf(a)))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// roomAndAgent parses room_id and agent_id of the form, f.mu must be held.
+func (f *FakeQiscus) roomAndAgent(w http.ResponseWriter, r *http.Request) (*FakeRoom, *fakeAgent, bool) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	room, ok := f.rooms[r.PostForm.Get("room_id")]
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	agentID, _ := strconv.Atoi(r.PostForm.Get("agent_id"))
+	a, ok := f.agents[agentID]
+	if !ok {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	return room, a, true
+}
+
+func (f *FakeQiscus) handleAssignAgent(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	room, a, ok := f.roomAndAgent(w, r)
+	if !ok {
+		return
+	}
+	if room.IsResolved {
+		http.Error(w, "Room is resolved", http.StatusBadRequest)
+		return
+	}
+
+	f.assign(room, a)
+
+	var res AssignAgentResponse
+	res.Data.AddedAgent.ID = a.ID
+	res.Data.AddedAgent.Name = a.Name
+	res.Data.AddedAgent.Email = a.Email
+	res.Data.AddedAgent.SdkEmail = a.Email
+	res.Data.AddedAgent.IsAvailable = a.Online
+	res.Data.AddedAgent.TypeAsString = "agent"
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (f *FakeQiscus) handleRemoveAgent(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	room, a, ok := f.roomAndAgent(w, r)
+	if !ok {
+		return
+	}
+
+	if room.AgentID == a.ID {
+		room.AgentID = 0
+		delete(a.rooms, room.ID)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"status": http.StatusOK})
+}
+
+func (f *FakeQiscus) handleAllocateAssignAgent(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	room, ok := f.rooms[r.PostForm.Get("room_id")]
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	a := f.leastBusyAgent()
+	if a == nil {
+		http.Error(w, "No agent available", http.StatusBadRequest)
+		return
+	}
+
+	f.assign(room, a)
+
+	var res AllocateAssignAgentResponse
+	res.Data.Agent.ID = a.ID
+	res.Data.Agent.Name = a.Name
+	res.Data.Agent.Email = a.Email
+	res.Data.Agent.SdkEmail = a.Email
+	res.Data.Agent.IsAvailable = a.Online
+	res.Data.Agent.Count = len(a.rooms)
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (f *FakeQiscus) handleMarkAsResolved(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	room, ok := f.rooms[r.PostForm.Get("room_id")]
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	// Like Qiscus, a room resolved through the API is told to the resolve
+	// webhook too, once
+	if !room.IsResolved {
+		data := f.resolvedWebhook(room)
+		f.resolve(room)
+		log.Printf("Fake room %s resolved through the API", room.ID)
+		f.sendWebhook(f.webhookUrl(f.resolvedUrl, WEBHOOK_MARK_AS_RESOLVED_PATH), data)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"status": http.StatusOK})
+}
+
+func (f *FakeQiscus) handleSendBotMessage(w http.ResponseWriter, r *http.Request) {
+	var req SendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.rooms[req.RoomID]; !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	switch req.Type {
+	case MessageTypeText, MessageTypeCustom, MessageTypeSystemEvent:
+	default:
+		http.Error(w, fmt.Sprintf("Unknown message type %q", req.Type), http.StatusBadRequest)
+		return
+	}
+
+	f.botMessages = append(f.botMessages, FakeBotMessage{
+		RoomID:  req.RoomID,
+		Type:    req.Type,
+		Message: req.Message,
+		Extras:  req.Extras,
+		SentAt:  time.Now(),
+	})
+
+	writeJSON(w, http.StatusOK, map[string]int{"status": http.StatusOK})
+}
+
+// customerRoom is the room as the room endpoints return it, f.mu must be
+// held.
+func (f *FakeQiscus) customerRoom(room *FakeRoom) CustomerRoom {
+	cr := CustomerRoom{
+		RoomID:        room.ID,
+		ServiceID:     room.ServiceID,
+		Name:          room.Name,
+		Source:        room.Source,
+		UserID:        room.Email,
+		IsResolved:    room.IsResolved,
+		IsWaiting:     !room.IsResolved && room.AgentID == 0,
+		LastCommentID: room.LastCommentID,
+		Tags:          slices.Clone(room.Tags),
+		Agents:        []RoomAgent{},
+		CreatedAt:     room.CreatedAt,
+	}
+	if cr.Tags == nil {
+		cr.Tags = []string{}
+	}
+	if a, ok := f.agents[room.AgentID]; ok {
+		cr.Agents = append(cr.Agents, RoomAgent{ID: a.ID, Name: a.Name, Email: a.Email})
+	}
+
+	return cr
+}
+
+func (f *FakeQiscus) handleGetRoom(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	room, ok := f.rooms[chi.URLParam(r, "room_id")]
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	var res GetRoomResponse
+	res.Status = http.StatusOK
+	res.Data.CustomerRoom = f.customerRoom(room)
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleListRooms pages through the rooms oldest first, the cursor is the
+// id of the last room of the previous page.
+func (f *FakeQiscus) handleListRooms(w http.ResponseWriter, r *http.Request) {
+	var req ListRoomsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if req.Limit <= 0 || req.Limit > 100 {
+		req.Limit = listRoomsPageSize
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	older := func(a, b *FakeRoom) bool {
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		x, _ := strconv.Atoi(a.ID)
+		y, _ := strconv.Atoi(b.ID)
+		return x < y
+	}
+
+	// The cursor room may have changed status since the previous page
+	cursor := f.rooms[req.CursorAfter]
+
+	rooms := []*FakeRoom{}
+	for _, room := range f.rooms {
+		switch {
+		case cursor != nil && !older(cursor, room):
+			continue
+		case req.Status == "unresolved" && room.IsResolved,
+			req.Status == "resolved" && !room.IsResolved,
+			req.ServeStatus == RoomsServed && room.AgentID == 0,
+			req.ServeStatus == RoomsUnserved && room.AgentID != 0:
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return older(rooms[i], rooms[j]) })
+
+	var res ListRoomsResponse
+	res.Status = http.StatusOK
+	res.Data.CustomerRooms = []CustomerRoom{}
+	for _, room := range rooms[:min(req.Limit, len(rooms))] {
+		res.Data.CustomerRooms = append(res.Data.CustomerRooms, f.customerRoom(room))
+	}
+	if len(rooms) > req.Limit {
+		res.Meta.CursorAfter = rooms[req.Limit-1].ID
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (f *FakeQiscus) handleAddRoomTag(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	room, ok := f.rooms[r.PostForm.Get("room_id")]
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	tag := strings.TrimSpace(r.PostForm.Get("tag"))
+	if tag == "" {
+		http.Error(w, "Tag is required", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(room.Tags, tag) {
+		room.Tags = append(room.Tags, tag)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"status": http.StatusOK})
+}
+
+func (f *FakeQiscus) handleState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, f.State())
+}
+
+func (f *FakeQiscus) handleNewRoom(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Source string `json:"source"`
+		Name   string `json:"name"`
+		Email  string `json:"email"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Source == "" {
+		req.Source = "qiscus"
+	}
+	if req.Name == "" {
+		req.Name = "Customer"
+	}
+	if req.Email == "" {
+		req.Email = fmt.Sprintf("customer%d@fake.qiscus", time.Now().UnixNano())
+	}
+
+	writeJSON(w, http.StatusCreated, f.NewRoom(req.Source, req.Name, req.Email))
+}
+
+func (f *FakeQiscus) handleRoomMessage(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FromAgent bool   `json:"from_agent"`
+		Text      string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	err := f.SendMessage(chi.URLParam(r, "room_id"), req.FromAgent, req.Text)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *FakeQiscus) handleAgentResolve(w http.ResponseWriter, r *http.Request) {
+	if err := f.ResolveRoom(chi.URLParam(r, "room_id")); err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *FakeQiscus) handleAgentOnline(online bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		agentID, err := strconv.Atoi(chi.URLParam(r, "agent_id"))
+		if err != nil {
+			http.Error(w, "Invalid agent id", http.StatusBadRequest)
+			return
+		}
+
+		if err := f.SetOnline(agentID, online); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func runFakeQiscus(c *config) {
+	ctx := context.Background()
+
+	f := NewFakeQiscus(c.QiscusConfig, c.WebhookConfig.BaseUrl, c.FakeQiscus.Agents)
+	f.Play(ctx)
+
+	listenPort := fmt.Sprintf(":%d", c.FakeQiscus.Port)
+	fmt.Printf("Fake Qiscus listening on port: %s\n", listenPort)
+
+	http.ListenAndServe(listenPort, f)
+}
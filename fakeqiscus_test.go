@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestFakeQiscusRoundTrip logs in, takes a room from its allocate webhook
+// to an agent and resolves it, all through the client against the fake.
+func TestFakeQiscusRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	allocates := make(chan WebhookIncomingMessageRequest, 1)
+	resolves := make(chan WebhookMarkAsResolvedRequest, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case WEBHOOK_INCOMING_MESSAGE_PATH:
+			var wimr WebhookIncomingMessageRequest
+			if json.NewDecoder(r.Body).Decode(&wimr) == nil {
+				allocates <- wimr
+			}
+		case WEBHOOK_MARK_AS_RESOLVED_PATH:
+			var data WebhookMarkAsResolvedRequest
+			if json.NewDecoder(r.Body).Decode(&data) == nil {
+				resolves <- data
+			}
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	qc := qiscusConfig{AppID: "test-app", SecretKey: "secret", Email: "admin@fake.qiscus", Password: "password"}
+	f := NewFakeQiscus(qc, receiver.URL, []fakeAgentConfig{{ID: 1, Name: "Ann", Online: true}})
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	qc.BaseUrl = srv.URL
+
+	// Auth
+	if _, err := NewLoginRequest(qc.Email, "wrong").Login(ctx, qc.BaseUrl); err == nil {
+		t.Error("Login with a wrong password succeeded")
+	}
+
+	wrong := qc
+	wrong.SecretKey = "wrong"
+	if _, err := newQiscusHTTP(func() qiscusConfig { return wrong }, &memTokens{}).GetAllAgents(ctx); err == nil {
+		t.Error("GetAllAgents with a wrong secret key succeeded")
+	}
+
+	tokens := &memTokens{}
+	q := newQiscusHTTP(func() qiscusConfig { return qc }, tokens)
+
+	webhookUrl := receiver.URL + WEBHOOK_INCOMING_MESSAGE_PATH
+	if _, err := q.SetWebhookIncomingMessage(ctx, webhookUrl); err != nil {
+		t.Fatalf("SetWebhookIncomingMessage: %v", err)
+	}
+
+	// The webhook config is only served with the token of a login
+	config, err := q.GetWebhookConfig(ctx)
+	if err != nil {
+		t.Fatalf("GetWebhookConfig: %v", err)
+	}
+	if len(config.Data.WebhookConfigs) != 1 || config.Data.WebhookConfigs[0].URL != webhookUrl {
+		t.Errorf("webhook configs = %+v, want %s", config.Data.WebhookConfigs, webhookUrl)
+	}
+	if token, err := tokens.Token(ctx, qc.AppID+":"+qc.Email); err != nil || token == "" {
+		t.Errorf("token not cached after login: %q, %v", token, err)
+	}
+
+	// Assign
+	room := f.NewRoom("wa", "Jane", "jane@example.com")
+
+	select {
+	case wimr := <-allocates:
+		if wimr.RoomID != room.ID || wimr.LatestService.ID != room.ServiceID || wimr.Source != "wa" {
+			t.Errorf("allocate webhook = %+v, want room %s session %d", wimr, room.ID, room.ServiceID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no allocate webhook for the new room")
+	}
+
+	allocated, err := q.AllocateAssignAgent(ctx, room.ID)
+	if err != nil {
+		t.Fatalf("AllocateAssignAgent: %v", err)
+	}
+	if allocated.Data.Agent.ID != 1 {
+		t.Errorf("allocated agent = %d, want 1", allocated.Data.Agent.ID)
+	}
+	if got := fakeRoom(t, f, room.ID).AgentID; got != 1 {
+		t.Errorf("agent of the room = %d, want 1", got)
+	}
+	if got := f.State().Agents[0].CurrentCustomerCount; got != 1 {
+		t.Errorf("customer count after assign = %d, want 1", got)
+	}
+
+	// Resolve
+	if err := q.Resolve(ctx, room.ID, "", room.LastCommentID); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if !fakeRoom(t, f, room.ID).IsResolved {
+		t.Error("room not resolved")
+	}
+	if got := f.State().Agents[0].CurrentCustomerCount; got != 0 {
+		t.Errorf("customer count after resolve = %d, want 0", got)
+	}
+
+	select {
+	case data := <-resolves:
+		if data.Service.RoomID != room.ID || data.Service.ID != room.ServiceID || data.ResolvedBy.ID != 1 {
+			t.Errorf("resolve webhook = %+v, want room %s session %d by agent 1", data, room.ID, room.ServiceID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no resolve webhook for the room resolved through the API")
+	}
+}
@@ -6,11 +6,11 @@ import (
 	"io"
 	"log"
 	"net/http"
-
-	"github.com/redis/go-redis/v9"
+	"net/url"
+	"time"
 )
 
-func HandleIncomingMessage(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandleIncomingMessage(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
@@ -24,23 +24,36 @@ func HandleIncomingMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task, err := NewChatAssignAgentTask(&data)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create task: %v", err), http.StatusInternalServerError)
+	ctx := r.Context()
+
+	park := !s.IsChannelOpen(data.Source, time.Now())
+	if !park {
+		park, err = s.hasParkedRooms(ctx, data.Source)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not check parked rooms: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if park {
+		err = s.ParkRoom(ctx, &data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not park room: %v", err), http.StatusInternalServerError)
+		}
 		return
 	}
 
-	info, err := queueClient.Enqueue(task)
+	err = s.EnqueueChatAssignAgent(ctx, &data)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("could not enqueue task: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	fmt.Printf("enqueued task: id=%s queue=%s", info.ID, info.Queue)
 
 	return
 }
 
-func HandleGetAllAgent(w http.ResponseWriter, r *http.Request) {
-	agents, err := GetAllAgent()
+func (s *Service) HandleGetAllAgent(w http.ResponseWriter, r *http.Request) {
+	agents, err := s.Qiscus.GetAllAgents(r.Context())
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get all agents: %v", err), http.StatusInternalServerError)
 		return
@@ -55,10 +68,10 @@ func HandleGetAllAgent(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandlerGetWebhookConfig(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandlerGetWebhookConfig(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	config, err := GetWebhookConfig(ctx)
+	config, err := s.Qiscus.GetWebhookConfig(ctx)
 	if err != nil {
 		http.Error(w, "Failed to get webhook config", http.StatusInternalServerError)
 		return
@@ -72,14 +85,23 @@ func HandlerGetWebhookConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandlerSetWebhook(w http.ResponseWriter, r *http.Request) {
-	res, err := SetWebHookIncomingMessage(cfg.WebhookConfig.BaseUrl + WEBHOOK_INCOMING_MESSAGE_PATH)
+func (s *Service) HandlerSetWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	t := s.conf()
+
+	// Tenants are told apart by the app_id of the webhook url
+	query := ""
+	if t.name != "" {
+		query = "?app_id=" + url.QueryEscape(t.QiscusConfig.AppID)
+	}
+
+	res, err := s.Qiscus.SetWebhookIncomingMessage(ctx, t.WebhookConfig.BaseUrl+WEBHOOK_INCOMING_MESSAGE_PATH+query)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to set webhook config: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	res, err = SetWebHookMarkAsResolved(cfg.WebhookConfig.BaseUrl + WEBHOOK_MARK_AS_RESOLVED_PATH)
+	res, err = s.Qiscus.SetWebhookMarkAsResolved(ctx, t.WebhookConfig.BaseUrl+WEBHOOK_MARK_AS_RESOLVED_PATH+query)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to set webhook config: %v", err), http.StatusInternalServerError)
 		return
@@ -93,7 +115,7 @@ func HandlerSetWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandleMarkAsResolved(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandleMarkAsResolved(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	body, err := io.ReadAll(r.Body)
@@ -111,43 +133,65 @@ func HandleMarkAsResolved(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Webhook mark as resolved: %v", data)
 
-	agentID := data.ResolvedBy.ID
+	abandoned, err := s.AbandonWaitingRoom(ctx, &data)
+	if err != nil {
+		log.Printf("Failed to abandon room %s: %v", data.Service.RoomID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if abandoned {
+		return
+	}
 
-	roomAgentKey := fmt.Sprintf("room:%s:agent", data.Service.RoomID)
-	roomAgent, err := rdb.Get(ctx, roomAgentKey).Int()
-	if err != nil && err != redis.Nil {
-		log.Printf("Failed to find room %s", data.Service.RoomID)
-		http.Error(w, "Failed to find room agent", http.StatusBadRequest)
+	_, err = s.ReleaseRoomAgent(ctx, data.Service.RoomID, data.Service.ID, data.ResolvedBy.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if roomAgent > 0 {
-		log.Printf("Found %s:%d", roomAgentKey, roomAgent)
-		agentID = roomAgent
+	return
+}
+
+func (s *Service) HandleNewMessage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
 	}
 
-	customerCountKey := fmt.Sprintf("agent:%d:customer_count", agentID)
-	customerCount, err := rdb.Get(ctx, customerCountKey).Int()
+	var data WebhookNewMessageRequest
+	err = json.Unmarshal(body, &data)
 	if err != nil {
-		if err == redis.Nil {
-			return
-		}
-		log.Printf("Failed to find customer count of agent %d", agentID)
-		http.Error(w, "Failed to find customer count key", http.StatusBadRequest)
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	roomID := string(data.Payload.Room.ID)
+	if roomID == "" {
+		http.Error(w, "Missing room id", http.StatusBadRequest)
 		return
 	}
 
-	err = rdb.Decr(ctx, customerCountKey).Err()
+	// Our own bot messages, like the idle warning, are not activity
+	if data.Payload.From.Email == s.conf().QiscusConfig.Email {
+		return
+	}
+
+	err = s.RecordRoomActivity(ctx, roomID, string(data.Payload.Message.ID))
 	if err != nil {
-		log.Printf("Failed to decreasing customer count of agent %d, from %d to %d", agentID, customerCount, customerCount-1)
-		http.Error(w, "Failed to decrease customer count", http.StatusBadRequest)
+		log.Printf("Failed to record activity of room %s: %v", roomID, err)
+		http.Error(w, "Failed to record room activity", http.StatusInternalServerError)
 		return
 	}
 
-	if roomAgent > 0 {
-		rdb.Del(ctx, roomAgentKey)
+	err = s.RecordAgentResponse(ctx, roomID, data.Payload.From.Email)
+	if err != nil {
+		log.Printf("Failed to record agent response of room %s: %v", roomID, err)
+		http.Error(w, "Failed to record agent response", http.StatusInternalServerError)
+		return
 	}
 
-	log.Printf("Decreasing customer count of agent %d, from %d to %d", agentID, customerCount, customerCount-1)
 	return
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// channelHours returns the business hours of the webhook source, falling
+// back to the "default" channel.
+func (s *Service) channelHours(source string) (channelHoursConfig, bool) {
+	channels := s.conf().BusinessHours.Channels
+
+	if ch, ok := channels[source]; ok {
+		return ch, true
+	}
+
+	ch, ok := channels["default"]
+	return ch, ok
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// isOpenAt reports whether the channel is open at t. Channels without any
+// configured days are always open.
+func isOpenAt(ch channelHoursConfig, t time.Time) (bool, error) {
+	if len(ch.Days) == 0 {
+		return true, nil
+	}
+
+	loc := time.UTC
+	if ch.Timezone != "" {
+		l, err := time.LoadLocation(ch.Timezone)
+		if err != nil {
+			return false, fmt.Errorf("invalid timezone %q: %w", ch.Timezone, err)
+		}
+		loc = l
+	}
+
+	local := t.In(loc)
+
+	date := local.Format("2006-01-02")
+	for _, holiday := range ch.Holidays {
+		if holiday == date {
+			return false, nil
+		}
+	}
+
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+	for _, hours := range ch.Days[strings.ToLower(local.Weekday().String())] {
+		from, to, ok := strings.Cut(hours, "-")
+		if !ok {
+			return false, fmt.Errorf("invalid opening hours %q", hours)
+		}
+
+		start, err := parseClock(from)
+		if err != nil {
+			return false, fmt.Errorf("invalid opening hours %q: %w", hours, err)
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return false, fmt.Errorf("invalid opening hours %q: %w", hours, err)
+		}
+
+		if sinceMidnight >= start && sinceMidnight < end {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// IsChannelOpen reports whether rooms of the source can be allocated now.
+func (s *Service) IsChannelOpen(source string, t time.Time) bool {
+	if !s.conf().BusinessHours.Enabled {
+		return true
+	}
+
+	ch, ok := s.channelHours(source)
+	if !ok {
+		return true
+	}
+
+	open, err := isOpenAt(ch, t)
+	if err != nil {
+		// A broken calendar should not hold rooms back forever
+		log.Printf("Business hours of %s: %v", source, err)
+		return true
+	}
+
+	return open
+}
+
+// ParkRoom holds the room until its channel opens again. Parked rooms are
+// released in FIFO order.
+func (s *Service) ParkRoom(ctx context.Context, wimr *WebhookIncomingMessageRequest) error {
+	now := time.Now()
+	err := s.Rooms.ParkRoom(ctx, wimr, now)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Room %s parked until %s opens", wimr.RoomID, wimr.Source)
+	s.PublishEvent(ctx, Event{Type: EventRoomParked, RoomID: wimr.RoomID})
+
+	// A room parked behind the parked rooms of an open channel is not told
+	// the channel is closed
+	if s.IsChannelOpen(wimr.Source, now) {
+		return nil
+	}
+
+	if ch, ok := s.channelHours(wimr.Source); ok && ch.AutoReply != "" {
+		if err := s.Qiscus.SendBotMessage(ctx, wimr.RoomID, ch.AutoReply); err != nil {
+			log.Printf("Error sending closed auto reply to room %s: %v", wimr.RoomID, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) isAnyAgentOnline(ctx context.Context) (bool, error) {
+	agentIDs, err := s.Agents.AgentIDs(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, id := range agentIDs {
+		isOnline, err := s.Agents.IsOnline(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if isOnline {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// hasParkedRooms tells whether rooms of the channel are still parked. A
+// room arriving then is parked behind them so the channel stays FIFO.
+func (s *Service) hasParkedRooms(ctx context.Context, source string) (bool, error) {
+	roomIDs, err := s.Rooms.ParkedRoomIDs(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, roomID := range roomIDs {
+		wimr, err := s.Rooms.ParkedRoom(ctx, roomID)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrMalformed) {
+				continue
+			}
+			return false, fmt.Errorf("Get parked room error: %w", err)
+		}
+		if wimr.Source == source {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ReleaseParkedRooms enqueues parked rooms, oldest first, whose channel is
+// open again once at least one agent is online.
+func (s *Service) ReleaseParkedRooms(ctx context.Context) error {
+	roomIDs, err := s.Rooms.ParkedRoomIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(roomIDs) == 0 {
+		return nil
+	}
+
+	online, err := s.isAnyAgentOnline(ctx)
+	if err != nil {
+		return err
+	}
+	if !online {
+		return nil
+	}
+
+	now := time.Now()
+	for _, roomID := range roomIDs {
+		wimr, err := s.Rooms.ParkedRoom(ctx, roomID)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				s.Rooms.UnparkRoom(ctx, roomID)
+				continue
+			}
+			if errors.Is(err, ErrMalformed) {
+				log.Printf("Dropping malformed parked room %s: %v", roomID, err)
+				s.Rooms.UnparkRoom(ctx, roomID)
+				continue
+			}
+			return fmt.Errorf("Get parked room error: %w", err)
+		}
+
+		if !s.IsChannelOpen(wimr.Source, now) {
+			continue
+		}
+
+		// The wait counts from when the room was parked
+		arrivedAt, err := s.Rooms.ArrivedAt(ctx, roomID)
+		if err != nil {
+			arrivedAt = now
+		}
+
+		if err := s.enqueueChatAssignAgent(ctx, wimr, arrivedAt); err != nil {
+			return err
+		}
+
+		s.Rooms.UnparkRoom(ctx, roomID)
+		log.Printf("Parked room %s released", roomID)
+	}
+
+	return nil
+}
@@ -1,10 +1,60 @@
-CREATE TYPE chat_status AS ENUM ('UNSERVED', 'SERVED');
+CREATE TYPE chat_status AS ENUM ('UNSERVED', 'SERVED', 'ABANDONED');
 
 CREATE TABLE chat (
     id SERIAL PRIMARY KEY,
+    -- empty for the default tenant
+    tenant VARCHAR NOT NULL DEFAULT '',
     room_id VARCHAR NOT NULL,
+    -- the Qiscus service session, a re-opened room gets a new one
+    service_id INTEGER NOT NULL DEFAULT 0,
     status chat_status NOT NULL DEFAULT 'UNSERVED',
     data JSONB NOT NULL,
+    -- set when the room was resolved before it got an agent
+    abandoned_at TIMESTAMP,
+    wait_seconds DOUBLE PRECISION,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-);
\ No newline at end of file
+);
+
+CREATE UNIQUE INDEX chat_tenant_room_service_idx ON chat (tenant, room_id, service_id);
+
+CREATE TABLE agent_shift (
+    id SERIAL PRIMARY KEY,
+    tenant VARCHAR NOT NULL DEFAULT '',
+    agent_id INTEGER NOT NULL,
+    starts_at TIMESTAMPTZ NOT NULL,
+    ends_at TIMESTAMPTZ NOT NULL,
+    -- NULL means no limit
+    max_chats INTEGER,
+    assigned_chats INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (ends_at > starts_at)
+);
+
+CREATE INDEX agent_shift_window_idx ON agent_shift (tenant, starts_at, ends_at);
+
+CREATE TABLE agent_shift_break (
+    id SERIAL PRIMARY KEY,
+    shift_id INTEGER NOT NULL REFERENCES agent_shift (id) ON DELETE CASCADE,
+    starts_at TIMESTAMPTZ NOT NULL,
+    ends_at TIMESTAMPTZ NOT NULL,
+    CHECK (ends_at > starts_at)
+);
+
+CREATE TYPE assignment_kind AS ENUM ('ASSIGN', 'ESCALATION', 'TRANSFER');
+
+CREATE TABLE assignment (
+    id SERIAL PRIMARY KEY,
+    tenant VARCHAR NOT NULL DEFAULT '',
+    room_id VARCHAR NOT NULL,
+    service_id INTEGER NOT NULL DEFAULT 0,
+    agent_id INTEGER NOT NULL,
+    previous_agent_id INTEGER,
+    kind assignment_kind NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    actor VARCHAR NOT NULL DEFAULT '',
+    explanation JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX assignment_room_id_idx ON assignment (tenant, room_id);
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hibiken/asynq"
+)
+
+// Assign agent tasks are enqueued into QUEUE_DEFAULT. QUEUE_PRIORITY is
+// served strictly before it and holds the rooms moved to the front.
+// QUEUE_SCHEDULED holds the delayed room checks, it is processed by its own
+// server so they do not wait behind the assignments. Every tenant but the
+// default one has its own set, prefixed with its name.
+const (
+	QUEUE_DEFAULT   = "default"
+	QUEUE_PRIORITY  = "priority"
+	QUEUE_SCHEDULED = "scheduled"
+)
+
+func (s *Service) assignQueues() []string {
+	t := s.conf()
+	return []string{t.queue(QUEUE_PRIORITY), t.queue(QUEUE_DEFAULT)}
+}
+
+type QueueSummary struct {
+	Queue          string  `json:"queue"`
+	Paused         bool    `json:"paused"`
+	Pending        int     `json:"pending"`
+	Active         int     `json:"active"`
+	Scheduled      int     `json:"scheduled"`
+	Retry          int     `json:"retry"`
+	Archived       int     `json:"archived"`
+	LatencySeconds float64 `json:"latency_seconds"`
+}
+
+type QueuedRoom struct {
+	TaskID        string    `json:"task_id"`
+	Queue         string    `json:"queue"`
+	State         string    `json:"state"`
+	RoomID        string    `json:"room_id"`
+	Name          string    `json:"name"`
+	Email         string    `json:"email"`
+	Source        string    `json:"source"`
+	Retried       int       `json:"retried"`
+	MaxRetry      int       `json:"max_retry"`
+	LastErr       string    `json:"last_error,omitempty"`
+	NextProcessAt time.Time `json:"next_process_at,omitempty"`
+}
+
+func newQueuedRoom(info *asynq.TaskInfo) QueuedRoom {
+	qr := QueuedRoom{
+		TaskID:        info.ID,
+		Queue:         info.Queue,
+		State:         info.State.String(),
+		Retried:       info.Retried,
+		MaxRetry:      info.MaxRetry,
+		LastErr:       info.LastErr,
+		NextProcessAt: info.NextProcessAt,
+	}
+
+	var wimr WebhookIncomingMessageRequest
+	if err := json.Unmarshal(info.Payload, &wimr); err == nil {
+		qr.RoomID = wimr.RoomID
+		qr.Name = wimr.Name
+		qr.Email = wimr.Email
+		qr.Source = wimr.Source
+	}
+
+	return qr
+}
+
+func (s *Service) requestQueues(r *http.Request) ([]string, error) {
+	queues := s.assignQueues()
+
+	queue := r.URL.Query().Get("queue")
+	if queue == "" {
+		return queues, nil
+	}
+
+	for _, q := range queues {
+		if q == queue {
+			return []string{q}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown queue %q", queue)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+func (s *Service) HandleGetQueues(w http.ResponseWriter, r *http.Request) {
+	summaries := []QueueSummary{}
+	for _, queue := range s.assignQueues() {
+		info, err := s.Queue.GetQueueInfo(queue)
+		if err != nil {
+			if errors.Is(err, asynq.ErrQueueNotFound) {
+				summaries = append(summaries, QueueSummary{Queue: queue})
+				continue
+			}
+			http.Error(w, fmt.Sprintf("Failed to get queue %s: %v", queue, err), http.StatusInternalServerError)
+			return
+		}
+
+		summaries = append(summaries, QueueSummary{
+			Queue:          info.Queue,
+			Paused:         info.Paused,
+			Pending:        info.Pending,
+			Active:         info.Active,
+			Scheduled:      info.Scheduled,
+			Retry:          info.Retry,
+			Archived:       info.Archived,
+			LatencySeconds: info.Latency.Seconds(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func (s *Service) HandleListQueuedRooms(w http.ResponseWriter, r *http.Request) {
+	queues, err := s.requestQueues(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		state = "pending"
+	}
+	if !slices.Contains([]string{"pending", "active", "scheduled", "retry", "archived"}, state) {
+		http.Error(w, fmt.Sprintf("Unknown task state %q", state), http.StatusBadRequest)
+		return
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+	if size < 1 {
+		size = 50
+	}
+
+	rooms := []QueuedRoom{}
+	for _, queue := range queues {
+		tasks, err := s.Queue.ListTasks(queue, state, asynq.Page(page), asynq.PageSize(size))
+		if err != nil {
+			if errors.Is(err, asynq.ErrQueueNotFound) {
+				continue
+			}
+			http.Error(w, fmt.Sprintf("Failed to list %s tasks of %s: %v", state, queue, err), http.StatusInternalServerError)
+			return
+		}
+
+		for _, task := range tasks {
+			if task.Type != TypeChatAssignAgent {
+				continue
+			}
+			rooms = append(rooms, newQueuedRoom(task))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+func (s *Service) HandlePauseQueue(w http.ResponseWriter, r *http.Request) {
+	queues, err := s.requestQueues(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, queue := range queues {
+		if err := s.Queue.PauseQueue(queue); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to pause %s: %v", queue, err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Queue %s paused", queue)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) HandleResumeQueue(w http.ResponseWriter, r *http.Request) {
+	queues, err := s.requestQueues(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, queue := range queues {
+		if err := s.Queue.UnpauseQueue(queue); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to resume %s: %v", queue, err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Queue %s resumed", queue)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) HandleDeleteQueuedTask(w http.ResponseWriter, r *http.Request) {
+	queue := chi.URLParam(r, "queue")
+	taskID := chi.URLParam(r, "task_id")
+
+	// Only the queues of the request's tenant can be touched
+	if !slices.Contains(s.assignQueues(), queue) && queue != s.conf().queue(QUEUE_SCHEDULED) {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	err := s.Queue.DeleteTask(queue, taskID)
+	if err != nil {
+		switch {
+		case errors.Is(err, asynq.ErrQueueNotFound), errors.Is(err, asynq.ErrTaskNotFound):
+			http.Error(w, "Task not found", http.StatusNotFound)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to delete task: %v", err), http.StatusConflict)
+		}
+		return
+	}
+
+	log.Printf("Task %s deleted from %s", taskID, queue)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findRoomTask looks up the assign agent task of a room in state. A
+// serviceID above zero only matches the task of that service session.
+func (s *Service) findRoomTask(queue, state, roomID string, serviceID int) (*asynq.TaskInfo, error) {
+	const pageSize = 100
+
+	for page := 1; ; page++ {
+		tasks, err := s.Queue.ListTasks(queue, state, asynq.Page(page), asynq.PageSize(pageSize))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, task := range tasks {
+			if task.Type != TypeChatAssignAgent {
+				continue
+			}
+
+			var wimr WebhookIncomingMessageRequest
+			if err := json.Unmarshal(task.Payload, &wimr); err != nil {
+				continue
+			}
+			if wimr.RoomID == roomID && (serviceID == 0 || wimr.LatestService.ID == serviceID) {
+				return task, nil
+			}
+		}
+
+		if len(tasks) < pageSize {
+			return nil, asynq.ErrTaskNotFound
+		}
+	}
+}
+
+func (s *Service) HandleMoveRoomToFront(w http.ResponseWriter, r *http.Request) {
+	// Once taken out, the room must get back into a queue even if the
+	// caller goes away
+	ctx := context.WithoutCancel(r.Context())
+	roomID := chi.URLParam(r, "room_id")
+	t := s.conf()
+
+	task, err := s.findRoomTask(t.queue(QUEUE_DEFAULT), "pending", roomID, 0)
+	if err != nil {
+		if errors.Is(err, asynq.ErrQueueNotFound) || errors.Is(err, asynq.ErrTaskNotFound) {
+			http.Error(w, "Room is not waiting in the queue", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to find room task: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Deleting first makes sure a worker did not pick the task up meanwhile
+	err = s.Queue.DeleteTask(task.Queue, task.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to take room out of the queue: %v", err), http.StatusConflict)
+		return
+	}
+
+	opts := []asynq.Option{asynq.MaxRetry(task.MaxRetry)}
+	if task.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(task.Timeout))
+	}
+	if !task.Deadline.IsZero() {
+		opts = append(opts, asynq.Deadline(task.Deadline))
+	}
+
+	info, err := s.Queue.Enqueue(ctx, asynq.NewTask(task.Type, task.Payload, opts...), asynq.Queue(t.queue(QUEUE_PRIORITY)))
+	if err != nil {
+		log.Printf("Failed to move room %s to the front, putting it back: %v", roomID, err)
+		if _, err := s.Queue.Enqueue(ctx, asynq.NewTask(task.Type, task.Payload, opts...), asynq.Queue(task.Queue)); err != nil {
+			log.Printf("Failed to put room %s back into %s: %v", roomID, task.Queue, err)
+		}
+		http.Error(w, fmt.Sprintf("Failed to move room to the front: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Room %s moved to the front, task %s", roomID, info.ID)
+	writeJSON(w, http.StatusOK, newQueuedRoom(info))
+}
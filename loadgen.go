@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type loadgenRoom struct {
+	createdAt  time.Time
+	assignedAt time.Time
+}
+
+// loadgen plays the customers and agents of a fake Qiscus server against the
+// webhook and worker services and times the assignments.
+type loadgen struct {
+	conf loadgenConfig
+	fake *FakeQiscus
+
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	rooms  map[string]*loadgenRoom
+	timers []*time.Timer
+}
+
+// sample draws a handle time from the distribution.
+func (hc handleTimeConfig) sample(rnd *rand.Rand) time.Duration {
+	switch hc.Distribution {
+	case "uniform":
+		return hc.Min + time.Duration(rnd.Int64N(int64(hc.Max-hc.Min)+1))
+	case "exponential":
+		return time.Duration(rnd.ExpFloat64() * float64(hc.Mean))
+	default:
+		return hc.Mean
+	}
+}
+
+// onAssign runs with the fake locked, the resolve comes later from a timer.
+func (lg *loadgen) onAssign(room FakeRoom) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	// The allocate webhook may come back before run knows the room
+	lr, ok := lg.rooms[room.ID]
+	if !ok {
+		lr = &loadgenRoom{}
+		lg.rooms[room.ID] = lr
+	}
+	if !lr.assignedAt.IsZero() {
+		return
+	}
+	lr.assignedAt = time.Now()
+
+	roomID := room.ID
+	lg.timers = append(lg.timers, time.AfterFunc(lg.conf.HandleTime.sample(lg.rnd), func() {
+		if err := lg.fake.ResolveRoom(roomID); err != nil {
+			log.Printf("Loadgen failed to resolve room %s: %v", roomID, err)
+		}
+	}))
+}
+
+func (lg *loadgen) run(ctx context.Context) {
+	log.Printf("Loadgen waiting %s for the services to start", lg.conf.Warmup)
+	time.Sleep(lg.conf.Warmup)
+
+	log.Printf("Loadgen opening %.2f rooms per second for %s", lg.conf.Rate, lg.conf.Duration)
+
+	end := time.Now().Add(lg.conf.Duration)
+	for n := 1; time.Now().Before(end); n++ {
+		// Poisson arrivals
+		wait := time.Duration(rand.ExpFloat64() / lg.conf.Rate * float64(time.Second))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		createdAt := time.Now()
+		room := lg.fake.NewRoom("qiscus", fmt.Sprintf("Load %d", n), fmt.Sprintf("load%d@loadgen.local", n))
+
+		lg.mu.Lock()
+		lr, ok := lg.rooms[room.ID]
+		if !ok {
+			lr = &loadgenRoom{}
+			lg.rooms[room.ID] = lr
+		}
+		lr.createdAt = createdAt
+		lg.mu.Unlock()
+	}
+
+	log.Printf("Loadgen waiting %s for the last assignments", lg.conf.Drain)
+	time.Sleep(lg.conf.Drain)
+
+	// Freeze the agents so the counters can settle
+	lg.mu.Lock()
+	for _, t := range lg.timers {
+		t.Stop()
+	}
+	lg.mu.Unlock()
+	time.Sleep(2 * time.Second)
+}
+
+type loadgenReport struct {
+	Created      int
+	Assigned     int
+	Resolved     int
+	TimeToAssign []time.Duration
+	Elapsed      time.Duration
+	Agents       int
+	Mismatches   []string
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// report compares what the fake knows with the counters the services keep.
+func (lg *loadgen) report(ctx context.Context, agents AgentStore) loadgenReport {
+	state := lg.fake.State()
+
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	var r loadgenReport
+	var first, last time.Time
+	for _, lr := range lg.rooms {
+		r.Created++
+		if first.IsZero() || lr.createdAt.Before(first) {
+			first = lr.createdAt
+		}
+		if lr.assignedAt.IsZero() {
+			continue
+		}
+
+		r.Assigned++
+		r.TimeToAssign = append(r.TimeToAssign, lr.assignedAt.Sub(lr.createdAt))
+		if lr.assignedAt.After(last) {
+			last = lr.assignedAt
+		}
+	}
+	sort.Slice(r.TimeToAssign, func(i, j int) bool { return r.TimeToAssign[i] < r.TimeToAssign[j] })
+	if !last.IsZero() {
+		r.Elapsed = last.Sub(first)
+	}
+
+	for _, room := range state.Rooms {
+		if room.IsResolved {
+			r.Resolved++
+			continue
+		}
+		if room.AgentID == 0 {
+			continue
+		}
+
+		agentID, err := agents.RoomAgent(ctx, room.ID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			r.Mismatches = append(r.Mismatches, fmt.Sprintf("room %s: %v", room.ID, err))
+			continue
+		}
+		if agentID != strconv.Itoa(room.AgentID) {
+			r.Mismatches = append(r.Mismatches, fmt.Sprintf("room %s: agent %q in the service, %d in Qiscus", room.ID, agentID, room.AgentID))
+		}
+	}
+
+	for _, a := range state.Agents {
+		r.Agents++
+
+		count, err := agents.CustomerCount(ctx, strconv.Itoa(a.ID))
+		if err != nil {
+			r.Mismatches = append(r.Mismatches, fmt.Sprintf("agent %d: %v", a.ID, err))
+			continue
+		}
+		if count != a.CurrentCustomerCount {
+			r.Mismatches = append(r.Mismatches, fmt.Sprintf("agent %d: customer count %d in the service, %d in Qiscus", a.ID, count, a.CurrentCustomerCount))
+		}
+	}
+
+	return r
+}
+
+func (r loadgenReport) Print() {
+	fmt.Printf("Rooms: %d created, %d assigned, %d unassigned, %d resolved\n", r.Created, r.Assigned, r.Created-r.Assigned, r.Resolved)
+
+	tta := r.TimeToAssign
+	fmt.Printf("Time to assign: p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(tta, 0.50).Round(time.Millisecond),
+		percentile(tta, 0.90).Round(time.Millisecond),
+		percentile(tta, 0.99).Round(time.Millisecond),
+		percentile(tta, 1).Round(time.Millisecond))
+
+	if r.Elapsed > 0 {
+		fmt.Printf("Throughput: %.2f assignments per second over %s\n", float64(r.Assigned)/r.Elapsed.Seconds(), r.Elapsed.Round(time.Millisecond))
+	}
+
+	if len(r.Mismatches) == 0 {
+		fmt.Printf("Counters: consistent for all %d agents\n", r.Agents)
+		return
+	}
+	fmt.Printf("Counters: %d mismatches\n", len(r.Mismatches))
+	for _, m := range r.Mismatches {
+		fmt.Printf("  %s\n", m)
+	}
+}
+
+func runLoadgen(c *config) {
+	ctx := context.Background()
+
+	agents := make([]fakeAgentConfig, 0, c.Loadgen.Agents)
+	for i := 1; i <= int(c.Loadgen.Agents); i++ {
+		agents = append(agents, fakeAgentConfig{ID: i, Online: true})
+	}
+
+	lg := &loadgen{
+		conf:  c.Loadgen,
+		fake:  NewFakeQiscus(c.QiscusConfig, c.WebhookConfig.BaseUrl, agents),
+		rnd:   rand.New(rand.NewPCG(uint64(time.Now().UnixNano()), 0)),
+		rooms: make(map[string]*loadgenRoom),
+	}
+	lg.fake.OnAssign = lg.onAssign
+
+	listenPort := fmt.Sprintf(":%d", c.FakeQiscus.Port)
+	fmt.Printf("Fake Qiscus listening on port: %s\n", listenPort)
+
+	go func() {
+		if err := http.ListenAndServe(listenPort, lg.fake); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	lg.run(ctx)
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr: c.RedisConfig.Url,
+	})
+	defer rdb.Close()
+
+	lg.report(ctx, newRedisStore(rdb, "")).Print()
+}
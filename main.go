@@ -6,8 +6,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
-	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -22,23 +20,21 @@ const (
 	ALLOCATE_AGENT_PATH          = "/api/v1/admin/service/allocate_agent"
 	ALLOCATE_ASSIGN_AGENT_PATH   = "/api/v1/admin/service/allocate_assign_agent"
 	ASSIGN_AGENT_PATH            = "/api/v1/admin/service/assign_agent"
+	REMOVE_AGENT_PATH            = "/api/v1/admin/service/remove_agent"
 	GET_ALL_AGENT_PATH           = "/api/v2/admin/agents?limit=1000"
 	GET_AVAILABLE_AGENT_PATH     = "/api/v2/admin/service/available_agents"
 	GET_WEBHOOK_CONFIG_PATH      = "/api/v2/admin/webhook_config"
 	SET_WEBHOOK_MARK_AS_RESOLVED = "/api/v1/app/webhook/mark_as_resolved"
 	SET_WEBHOOK_INCOMING_MESSAGE = "/api/v1/app/webhook/agent_allocation"
+	SEND_BOT_MESSAGE_PATH        = "/%s/bot"
+	GET_ROOM_PATH                = "/api/v2/customer_rooms/%s"
+	LIST_ROOMS_PATH              = "/api/v2/customer_rooms"
+	ADD_ROOM_TAG_PATH            = "/api/v1/room_tag/create"
 	CACHE_TOKEN_KEY              = "token"
 
 	WEBHOOK_MARK_AS_RESOLVED_PATH = "/webhook-mark-as-resolved"
 	WEBHOOK_INCOMING_MESSAGE_PATH = "/webhook-incoming-message"
-)
-
-var (
-	cfg         = defaultConfig()
-	rdb         *redis.Client
-	queueClient *asynq.Client
-	pool        *pgxpool.Pool
-	err         error
+	WEBHOOK_NEW_MESSAGE_PATH      = "/webhook-new-message"
 )
 
 func main() {
@@ -49,61 +45,125 @@ func main() {
 	// }
 
 	var configFileName, exec string
-	flag.StringVar(&exec, "e", "webhook", "Service to run. Use 'webhook' or 'worker'.")
+	flag.StringVar(&exec, "e", "webhook", "Service to run. Use 'webhook', 'worker', 'fake-qiscus', 'replay', 'loadgen' or 'simulate'.")
 	flag.StringVar(&configFileName, "c", "config.yml", "Config file name")
 
 	flag.Parse()
 
-	cfg.loadFromEnv()
+	c, err := buildConfig(configFileName, exec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg := newConfigHolder(c)
+
+	log.Printf("Effective config:\n%s", c.Redacted())
 
-	if len(configFileName) > 0 {
-		err := loadConfigFromFile(configFileName, &cfg)
-		if err != nil {
-			// log.Warn().Str("file", configFileName).Err(err).Msg("cannot load config file, use defaults")
+	// These modes need neither the stores nor the queue
+	switch exec {
+	case "fake-qiscus":
+		runFakeQiscus(c)
+		return
+	case "loadgen":
+		runLoadgen(c)
+		return
+	case "simulate":
+		runSimulate(c)
+		return
+	case "replay":
+		if err := Replay(c.Replay); err != nil {
+			log.Fatal(err)
 		}
+		return
 	}
 
-	// log.Debug().Any("config", cfg).Msg("config loaded")
-
 	ctx := context.Background()
 
-	fmt.Println("Webhook base url: ", cfg.WebhookConfig.BaseUrl)
+	fmt.Println("Webhook base url: ", c.WebhookConfig.BaseUrl)
 
-	rdb = redis.NewClient(&redis.Options{
-		Addr: cfg.RedisConfig.Url,
+	rdb := redis.NewClient(&redis.Options{
+		Addr: c.RedisConfig.Url,
 	})
 
-	queueClient = asynq.NewClient(asynq.RedisClientOpt{Addr: cfg.RedisConfig.Url})
+	queueClient := asynq.NewClient(asynq.RedisClientOpt{Addr: c.RedisConfig.Url})
 	if queueClient == nil {
 		fmt.Println("Error creating Asynq client")
 		panic("Failed to create Asynq client")
 	}
 
-	pool, err = pgxpool.New(ctx, cfg.DBConfig.ConnectionString)
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: c.RedisConfig.Url})
+
+	pool, err := pgxpool.New(ctx, c.DBConfig.ConnectionString)
 	if err != nil {
 		fmt.Printf("Error connecting to database: %v\n", err.Error())
 		panic(err)
 	}
 
+	queue := newAsynqQueue(queueClient, inspector)
+
+	var tenants Tenants
+	for _, t := range c.allTenants() {
+		store := newRedisStore(rdb, t.name)
+		s := &Service{
+			Tenant: t.name,
+			Agents: store,
+			Rooms:  store,
+			Chats:  newPgChats(pool, t.name),
+			Queue:  queue,
+			Events: store,
+			config: cfg,
+		}
+		s.Qiscus = newQiscusHTTP(func() qiscusConfig { return s.conf().QiscusConfig }, store)
+		tenants = append(tenants, s)
+	}
+
+	cfg.Watch(ctx, configFileName)
+
 	switch exec {
 	case "webhook":
-		runServer(int(cfg.Listen.Port))
+		runServer(tenants, c)
 	case "worker":
-		runWorker()
+		runWorker(tenants, c)
 	default:
-		fmt.Println("Invalid argument. Use 'webhook' or 'worker'.")
+		fmt.Println("Invalid argument. Use 'webhook', 'worker', 'fake-qiscus', 'replay', 'loadgen' or 'simulate'.")
 	}
 }
 
-func runServer(port int) {
+func runServer(tenants Tenants, c *config) {
+	port := int(c.Listen.Port)
+
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
-	r.Post(WEBHOOK_INCOMING_MESSAGE_PATH, HandleIncomingMessage)
-	r.Post(WEBHOOK_MARK_AS_RESOLVED_PATH, HandleMarkAsResolved)
-	r.Get("/agents", HandleGetAllAgent)
-	// r.Get("/webhook-config", HandlerGetWebhookConfig)
-	r.Post("/set-webhook", HandlerSetWebhook)
-	// r.Get("/get-available-agent", HandlerGetAvailableAgent)
+	r.Group(func(r chi.Router) {
+		if c.Recorder.Enabled {
+			rec, err := NewRecorder(c.Recorder.Path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Recording webhooks to %s", c.Recorder.Path)
+			r.Use(rec.Middleware)
+		}
+
+		r.Post(WEBHOOK_INCOMING_MESSAGE_PATH, tenants.HandleIncomingMessage)
+		r.Post(WEBHOOK_MARK_AS_RESOLVED_PATH, tenants.HTTP((*Service).HandleMarkAsResolved))
+		r.Post(WEBHOOK_NEW_MESSAGE_PATH, tenants.HTTP((*Service).HandleNewMessage))
+	})
+
+	if c.Admin.Port == 0 || c.Admin.Port == uint(port) {
+		r.Mount(c.Admin.Prefix, adminRouter(tenants, c))
+	} else {
+		ar := chi.NewRouter()
+		ar.Use(middleware.Logger)
+		ar.Mount(c.Admin.Prefix, adminRouter(tenants, c))
+
+		adminPort := fmt.Sprintf(":%d", c.Admin.Port)
+		fmt.Printf("Admin listening on port: %s\n", adminPort)
+
+		go func() {
+			if err := http.ListenAndServe(adminPort, ar); err != nil {
+				log.Printf("Admin server stopped: %v", err)
+			}
+		}()
+	}
 
 	listenPort := fmt.Sprintf(":%d", port)
 	fmt.Printf("Listening on port: %s\n", listenPort)
@@ -111,99 +171,118 @@ func runServer(port int) {
 	http.ListenAndServe(listenPort, r)
 }
 
-func runWorker() {
+func adminRouter(tenants Tenants, c *config) chi.Router {
+	r := chi.NewRouter()
+	r.Use(Authenticate(c.Admin.Keys))
+	r.Use(RequireTenant(tenants))
+
+	// viewer: read state
+	r.With(RequireRole(roleViewer)).Get("/agents", tenants.HTTP((*Service).HandleGetAllAgent))
+	r.With(RequireRole(roleViewer)).Get("/webhook-config", tenants.HTTP((*Service).HandlerGetWebhookConfig))
+	r.With(RequireRole(roleViewer)).Get("/events", tenants.HTTP((*Service).HandleEventStream))
+	r.With(RequireRole(roleViewer)).Get("/queue", tenants.HTTP((*Service).HandleGetQueues))
+	r.With(RequireRole(roleViewer)).Get("/queue/tasks", tenants.HTTP((*Service).HandleListQueuedRooms))
+	r.With(RequireRole(roleViewer)).Get("/shifts", tenants.HTTP((*Service).HandleListShifts))
+	r.With(RequireRole(roleViewer)).Get("/rooms/{room_id}/assignments", tenants.HTTP((*Service).HandleListRoomAssignments))
+	r.With(RequireRole(roleViewer)).Get("/agents/draining", tenants.HTTP((*Service).HandleListDrainingAgents))
+	r.With(RequireRole(roleViewer)).Get("/abandonment", tenants.HTTP((*Service).HandleGetAbandonment))
+	r.With(RequireRole(roleViewer)).Post("/explain", tenants.HTTP((*Service).HandleExplain))
+
+	// operator: change assignments
+	r.With(RequireRole(roleOperator)).Post("/queue/pause", tenants.HTTP((*Service).HandlePauseQueue))
+	r.With(RequireRole(roleOperator)).Post("/queue/resume", tenants.HTTP((*Service).HandleResumeQueue))
+	r.With(RequireRole(roleOperator)).Delete("/queue/tasks/{queue}/{task_id}", tenants.HTTP((*Service).HandleDeleteQueuedTask))
+	r.With(RequireRole(roleOperator)).Post("/queue/rooms/{room_id}/front", tenants.HTTP((*Service).HandleMoveRoomToFront))
+	r.With(RequireRole(roleOperator)).Post("/shifts", tenants.HTTP((*Service).HandleCreateShift))
+	r.With(RequireRole(roleOperator)).Delete("/shifts/{shift_id}", tenants.HTTP((*Service).HandleDeleteShift))
+	r.With(RequireRole(roleOperator)).Post("/rooms/{room_id}/transfer", tenants.HTTP((*Service).HandleTransferRoom))
+	r.With(RequireRole(roleOperator)).Post("/agents/{agent_id}/drain", tenants.HTTP((*Service).HandleDrainAgent))
+	r.With(RequireRole(roleOperator)).Delete("/agents/{agent_id}/drain", tenants.HTTP((*Service).HandleUndrainAgent))
+	r.With(RequireRole(roleOperator)).Post("/recovery/sync", tenants.HTTP((*Service).HandleRecoverySync))
+
+	// admin: change webhooks
+	r.With(RequireRole(roleAdmin)).Post("/set-webhook", tenants.HTTP((*Service).HandlerSetWebhook))
+
+	return r
+}
+
+func runWorker(tenants Tenants, c *config) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	fmt.Println("Starting worker...")
-	srv := asynq.NewServer(
-		asynq.RedisClientOpt{Addr: cfg.RedisConfig.Url},
-		asynq.Config{
-			Concurrency: 1,
-		},
-	)
-
-	if err := CacheAgentStatus(); err != nil {
-		panic(fmt.Errorf("Initial agent cache update failed: %w", err))
-	}
-	InitAgents(ctx)
 
-	mux := asynq.NewServeMux()
-	mux.HandleFunc(TypeChatAssignAgent, HandleChatAssignAgentTask)
-
-	if err := srv.Run(mux); err != nil {
-		panic(fmt.Sprintf("could not run server: %v", err))
+	for _, s := range tenants {
+		if err := s.CacheAgentStatus(ctx); err != nil {
+			panic(fmt.Errorf("Initial agent cache update of tenant %q failed: %w", s.Tenant, err))
+		}
+		// Rooms that came while we were down never got their webhook in
+		if _, err := s.RecoverFromQiscus(ctx); err != nil {
+			log.Printf("Recovering tenant %q from Qiscus failed: %v", s.Tenant, err)
+		}
+		if err := s.ReleaseParkedRooms(ctx); err != nil {
+			log.Printf("Releasing parked rooms of tenant %q failed: %v", s.Tenant, err)
+		}
 	}
-}
-
-func CacheAgentStatus() error {
-	ctx := context.Background()
+	tenants.InitAgents(ctx)
+	tenants.InitQueueMessages(ctx)
 
-	agents, err := GetAllAgent()
-	if err != nil {
-		return err
+	scheduledQueues := map[string]int{}
+	for _, s := range tenants {
+		scheduledQueues[s.conf().queue(QUEUE_SCHEDULED)] = 1
 	}
 
-	currentAgentIDs := make(map[string]struct{})
-	for _, agent := range agents.Data.Agents {
-		idStr := strconv.Itoa(agent.ID)
-		currentAgentIDs[idStr] = struct{}{}
-
-		err := rdb.SAdd(ctx, "agents:ids", idStr).Err()
-		if err != nil {
-			return fmt.Errorf("SAdd error: %w", err)
-		}
+	scheduledSrv := asynq.NewServer(
+		asynq.RedisClientOpt{Addr: c.RedisConfig.Url},
+		asynq.Config{
+			Concurrency: 5,
+			Queues:      scheduledQueues,
+		},
+	)
 
-		err = rdb.Set(ctx, fmt.Sprintf("agent:%s:is_online", idStr), agent.IsAvailable, 0).Err()
-		if err != nil {
-			return fmt.Errorf("Set is_online error: %w", err)
-		}
+	scheduledMux := asynq.NewServeMux()
+	scheduledMux.HandleFunc(TypeChatIdleCheck, tenants.Task((*Service).HandleChatIdleCheckTask))
+	scheduledMux.HandleFunc(TypeChatFirstResponseCheck, tenants.Task((*Service).HandleChatFirstResponseCheckTask))
+	scheduledMux.HandleFunc(TypeAgentDrain, tenants.Task((*Service).HandleAgentDrainTask))
 
-		_, err = rdb.Get(ctx, fmt.Sprintf("agent:%s:customer_count", idStr)).Int()
-		if err != nil {
-			if err == redis.Nil {
-				err = rdb.Set(ctx, fmt.Sprintf("agent:%s:customer_count", idStr), -1, 0).Err()
-				if err != nil {
-					return fmt.Errorf("Set customer_count error: %w", err)
-				}
-			} else {
-				return fmt.Errorf("Get customer_count error: %w", err)
-			}
-		}
+	if err := scheduledSrv.Start(scheduledMux); err != nil {
+		panic(fmt.Sprintf("could not start scheduled task server: %v", err))
 	}
-
-	existingIDs, err := rdb.SMembers(ctx, "agents:ids").Result()
-	if err != nil {
-		return fmt.Errorf("SMembers error: %w", err)
+	defer scheduledSrv.Shutdown()
+
+	// Every tenant assigns on its own server, so a tenant waiting for an
+	// agent does not hold the rooms of the others back
+	for _, s := range tenants[1:] {
+		srv := newAssignServer(s, c)
+		if err := srv.Start(newAssignMux(s)); err != nil {
+			panic(fmt.Sprintf("could not start server of tenant %q: %v", s.Tenant, err))
+		}
+		defer srv.Shutdown()
 	}
 
-	for _, id := range existingIDs {
-		if _, found := currentAgentIDs[id]; !found {
-			rdb.Del(ctx, fmt.Sprintf("agent:%s:is_online", id))
-			rdb.SRem(ctx, "agents:ids", id)
-		}
+	if err := newAssignServer(tenants[0], c).Run(newAssignMux(tenants[0])); err != nil {
+		panic(fmt.Sprintf("could not run server: %v", err))
 	}
+}
 
-	return nil
+func newAssignServer(s *Service, c *config) *asynq.Server {
+	t := s.conf()
+	return asynq.NewServer(
+		asynq.RedisClientOpt{Addr: c.RedisConfig.Url},
+		asynq.Config{
+			Concurrency: 1,
+			Queues: map[string]int{
+				t.queue(QUEUE_PRIORITY): 2,
+				t.queue(QUEUE_DEFAULT):  1,
+			},
+			StrictPriority: true,
+			RetryDelayFunc: s.RetryDelay(),
+		},
+	)
 }
 
-func InitAgents(ctx context.Context) {
-	ticker := time.NewTicker(1 * time.Minute)
-
-	go func() {
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				if err := CacheAgentStatus(); err != nil {
-					log.Println("Agent cache update failed:", err)
-				}
-				log.Println("Agent cache updated")
-			case <-ctx.Done():
-				log.Println("Stopping agent status updater")
-				return
-			}
-		}
-	}()
+func newAssignMux(s *Service) *asynq.ServeMux {
+	mux := asynq.NewServeMux()
+	mux.HandleFunc(TypeChatAssignAgent, s.HandleChatAssignAgentTask)
+	return mux
 }
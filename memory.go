@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// memAgentStore is an AgentStore kept in memory, for the simulator. It
+// behaves like the Redis one, including counters that start at zero when
+// incremented before they were set.
+type memAgentStore struct {
+	mu       sync.Mutex
+	emails   map[string][]string
+	online   map[string]bool
+	counts   map[string]int
+	rooms    map[string]string
+	services map[string]int
+	draining map[string]struct{}
+}
+
+func newMemAgentStore() *memAgentStore {
+	return &memAgentStore{
+		emails:   make(map[string][]string),
+		online:   make(map[string]bool),
+		counts:   make(map[string]int),
+		rooms:    make(map[string]string),
+		services: make(map[string]int),
+		draining: make(map[string]struct{}),
+	}
+}
+
+// AgentIDs returns the ids sorted, so ties are broken the same way every
+// run.
+func (m *memAgentStore) AgentIDs(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.emails))
+	for id := range m.emails {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (m *memAgentStore) IsAgent(ctx context.Context, agentID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.emails[agentID]
+	return ok, nil
+}
+
+func (m *memAgentStore) AddAgent(ctx context.Context, agentID string, emails []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.emails[agentID] = emails
+	return nil
+}
+
+func (m *memAgentStore) ForgetAgent(ctx context.Context, agentID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.emails, agentID)
+	delete(m.online, agentID)
+	return nil
+}
+
+func (m *memAgentStore) AgentEmails(ctx context.Context, agentID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.emails[agentID], nil
+}
+
+func (m *memAgentStore) SetOnline(ctx context.Context, agentID string, online bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous := m.online[agentID]
+	m.online[agentID] = online
+	return previous, nil
+}
+
+func (m *memAgentStore) IsOnline(ctx context.Context, agentID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.online[agentID], nil
+}
+
+func (m *memAgentStore) CustomerCount(ctx context.Context, agentID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count, ok := m.counts[agentID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return count, nil
+}
+
+func (m *memAgentStore) SetCustomerCount(ctx context.Context, agentID string, count int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counts[agentID] = count
+	return nil
+}
+
+func (m *memAgentStore) InitCustomerCount(ctx context.Context, agentID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.counts[agentID]; !ok {
+		m.counts[agentID] = -1
+	}
+	return nil
+}
+
+func (m *memAgentStore) RoomAgent(ctx context.Context, roomID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	agentID, ok := m.rooms[roomID]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return agentID, nil
+}
+
+func (m *memAgentStore) RoomService(ctx context.Context, roomID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	serviceID, ok := m.services[roomID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return serviceID, nil
+}
+
+func (m *memAgentStore) AssignRoom(ctx context.Context, roomID string, serviceID int, agentID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counts[agentID]++
+	m.rooms[roomID] = agentID
+	m.services[roomID] = serviceID
+	return m.counts[agentID], nil
+}
+
+func (m *memAgentStore) SetRoomAgent(ctx context.Context, roomID string, serviceID int, agentID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rooms[roomID] = agentID
+	m.services[roomID] = serviceID
+	return nil
+}
+
+func (m *memAgentStore) MappedRoomIDs(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roomIDs := make([]string, 0, len(m.rooms))
+	for roomID := range m.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	return roomIDs, nil
+}
+
+func (m *memAgentStore) ForgetRoom(ctx context.Context, roomID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.rooms, roomID)
+	delete(m.services, roomID)
+	return nil
+}
+
+func (m *memAgentStore) ReleaseRoom(ctx context.Context, roomID string, serviceID int, agentID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counts[agentID]--
+	current, ok := m.services[roomID]
+	if m.rooms[roomID] == agentID && (serviceID == 0 || !ok || current == serviceID) {
+		delete(m.rooms, roomID)
+		delete(m.services, roomID)
+	}
+	return m.counts[agentID], nil
+}
+
+func (m *memAgentStore) MoveRoom(ctx context.Context, roomID, fromAgentID, toAgentID string) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counts[fromAgentID]--
+	m.counts[toAgentID]++
+	m.rooms[roomID] = toAgentID
+	return m.counts[fromAgentID], m.counts[toAgentID], nil
+}
+
+func (m *memAgentStore) DrainingAgents(ctx context.Context) (map[string]struct{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	draining := make(map[string]struct{}, len(m.draining))
+	for id := range m.draining {
+		draining[id] = struct{}{}
+	}
+	return draining, nil
+}
+
+func (m *memAgentStore) SetDraining(ctx context.Context, agentID string, draining bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if draining {
+		m.draining[agentID] = struct{}{}
+	} else {
+		delete(m.draining, agentID)
+	}
+	return nil
+}
+
+func (m *memAgentStore) IsDraining(ctx context.Context, agentID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.draining[agentID]
+	return ok, nil
+}
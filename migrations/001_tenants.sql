@@ -0,0 +1,17 @@
+-- Tenants: a tenant column on every table, empty for the default tenant,
+-- and the indexes led by it. Safe to run more than once.
+BEGIN;
+
+ALTER TABLE chat ADD COLUMN IF NOT EXISTS tenant VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE agent_shift ADD COLUMN IF NOT EXISTS tenant VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE assignment ADD COLUMN IF NOT EXISTS tenant VARCHAR NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS chat_tenant_room_id_idx ON chat (tenant, room_id);
+
+DROP INDEX IF EXISTS agent_shift_window_idx;
+CREATE INDEX agent_shift_window_idx ON agent_shift (tenant, starts_at, ends_at);
+
+DROP INDEX IF EXISTS assignment_room_id_idx;
+CREATE INDEX assignment_room_id_idx ON assignment (tenant, room_id);
+
+COMMIT;
@@ -0,0 +1,46 @@
+-- Re-opened rooms: one chat row per room and Qiscus service session, and
+-- the session of every assignment. Run after 001_tenants.sql, safe to run
+-- more than once.
+BEGIN;
+
+ALTER TABLE chat ADD COLUMN IF NOT EXISTS service_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE assignment ADD COLUMN IF NOT EXISTS service_id INTEGER NOT NULL DEFAULT 0;
+
+UPDATE chat
+SET service_id = (data->'latest_service'->>'id')::int
+WHERE service_id = 0
+  AND data->'latest_service'->>'id' ~ '^[0-9]+$';
+
+-- An assignment belongs to the last session of its room created before it
+UPDATE assignment a
+SET service_id = COALESCE((
+    SELECT c.service_id
+    FROM chat c
+    WHERE c.tenant = a.tenant
+      AND c.room_id = a.room_id
+      AND c.created_at <= a.created_at
+    ORDER BY c.created_at DESC, c.id DESC
+    LIMIT 1
+), 0)
+WHERE a.service_id = 0;
+
+-- Rows of the same session, or of a room whose sessions are unknown, would
+-- break the unique index. The served and then newest row keeps the session,
+-- the others are kept with the negated id as service_id, where no session
+-- lookup finds them.
+UPDATE chat
+SET service_id = -chat.id
+FROM (
+    SELECT id, row_number() OVER (
+        PARTITION BY tenant, room_id, service_id
+        ORDER BY (status = 'SERVED') DESC, id DESC
+    ) AS n
+    FROM chat
+    WHERE service_id >= 0
+) d
+WHERE chat.id = d.id AND d.n > 1;
+
+DROP INDEX IF EXISTS chat_tenant_room_id_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS chat_tenant_room_service_idx ON chat (tenant, room_id, service_id);
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Abandoned chats: the ABANDONED status with when it happened and how long
+-- the customer waited. Run after 002_service_sessions.sql, safe to run more
+-- than once. ADD VALUE is kept out of a transaction, older Postgres versions
+-- refuse it inside one.
+ALTER TYPE chat_status ADD VALUE IF NOT EXISTS 'ABANDONED';
+
+ALTER TABLE chat ADD COLUMN IF NOT EXISTS abandoned_at TIMESTAMP;
+ALTER TABLE chat ADD COLUMN IF NOT EXISTS wait_seconds DOUBLE PRECISION;
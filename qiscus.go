@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 type LoginRequest struct {
@@ -106,6 +108,60 @@ type LoginResponse struct {
 	} `json:"data"`
 }
 
+// TokenCache keeps the Qiscus admin token of each account between requests.
+type TokenCache interface {
+	// Token returns ErrNotFound once the token expired
+	Token(ctx context.Context, account string) (string, error)
+	SetToken(ctx context.Context, account, token string, ttl time.Duration) error
+}
+
+// qiscusTimeout bounds every call to Qiscus, a hung connection would hold
+// the assign worker otherwise.
+const qiscusTimeout = 30 * time.Second
+
+// qiscusHTTP is the QiscusClient of one tenant. conf is read on every call
+// so reloads are picked up.
+type qiscusHTTP struct {
+	conf   func() qiscusConfig
+	tokens TokenCache
+	client *http.Client
+}
+
+func newQiscusHTTP(conf func() qiscusConfig, tokens TokenCache) *qiscusHTTP {
+	return &qiscusHTTP{conf: conf, tokens: tokens, client: &http.Client{Timeout: qiscusTimeout}}
+}
+
+// token returns the admin token, logging in when the cached one expired.
+// Tokens are cached per app and email, credentials changed by a reload log
+// in again.
+func (q *qiscusHTTP) token(ctx context.Context) (string, error) {
+	qc := q.conf()
+	account := qc.AppID + ":" + qc.Email
+
+	cachedToken, err := q.tokens.Token(ctx, account)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	if cachedToken != "" {
+		return cachedToken, nil
+	}
+
+	login := NewLoginRequest(qc.Email, qc.Password)
+	tokenResponse, err := login.Login(ctx, qc.BaseUrl)
+	if err != nil {
+		return "", err
+	}
+
+	token := tokenResponse.Data.User.AuthenticationToken
+
+	err = q.tokens.SetToken(ctx, account, token, time.Hour)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
 func NewLoginRequest(email, password string) *LoginRequest {
 	return &LoginRequest{
 		Email:    email,
@@ -113,15 +169,15 @@ func NewLoginRequest(email, password string) *LoginRequest {
 	}
 }
 
-func (r *LoginRequest) Login() (*LoginResponse, error) {
-	client := &http.Client{}
+func (r *LoginRequest) Login(ctx context.Context, baseUrl string) (*LoginResponse, error) {
+	client := &http.Client{Timeout: qiscusTimeout}
 
 	params := url.Values{}
 	params.Set("email", r.Email)
 	params.Set("password", r.Password)
 
 	payload := bytes.NewBufferString(params.Encode())
-	req, err := http.NewRequest("POST", cfg.QiscusConfig.BaseUrl+AUTH_PATH, payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", baseUrl+AUTH_PATH, payload)
 	if err != nil {
 		return nil, err
 	}
@@ -184,17 +240,18 @@ type Agent struct {
 	} `json:"user_roles"`
 }
 
-func GetAllAgent() (*GetAllAgentResponse, error) {
-	client := &http.Client{}
+func (q *qiscusHTTP) GetAllAgents(ctx context.Context) (*GetAllAgentResponse, error) {
+	qc := q.conf()
+	client := q.client
 
-	req, err := http.NewRequest("GET", cfg.QiscusConfig.BaseUrl+GET_ALL_AGENT_PATH, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", qc.BaseUrl+GET_ALL_AGENT_PATH, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Qiscus-App-Id", cfg.QiscusConfig.AppID)
-	req.Header.Set("Qiscus-Secret-Key", cfg.QiscusConfig.SecretKey)
+	req.Header.Set("Qiscus-App-Id", qc.AppID)
+	req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -254,17 +311,18 @@ type AvailableAgent struct {
 	} `json:"user_roles"`
 }
 
-func GetAvailableAgent(roomID string) (*GetAvailableAgentResponse, error) {
-	client := &http.Client{}
+func (q *qiscusHTTP) GetAvailableAgents(ctx context.Context, roomID string) (*GetAvailableAgentResponse, error) {
+	qc := q.conf()
+	client := q.client
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s?room_id=%s", cfg.QiscusConfig.BaseUrl, GET_AVAILABLE_AGENT_PATH, roomID), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s?room_id=%s", qc.BaseUrl, GET_AVAILABLE_AGENT_PATH, roomID), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Qiscus-App-Id", cfg.QiscusConfig.AppID)
-	req.Header.Set("Qiscus-Secret-Key", cfg.QiscusConfig.SecretKey)
+	req.Header.Set("Qiscus-App-Id", qc.AppID)
+	req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -311,23 +369,24 @@ type AssignAgentResponse struct {
 	} `json:"data"`
 }
 
-func (wimr *WebhookIncomingMessageRequest) AssignAgent(agentID int) (*AssignAgentResponse, error) {
-	client := &http.Client{}
+func (q *qiscusHTTP) AssignAgent(ctx context.Context, roomID string, agentID int) (*AssignAgentResponse, error) {
+	qc := q.conf()
+	client := q.client
 
 	params := url.Values{}
-	params.Set("room_id", wimr.RoomID)
+	params.Set("room_id", roomID)
 	params.Set("agent_id", fmt.Sprintf("%d", agentID))
 	params.Set("max_agent", "1")
 
 	payload := bytes.NewBufferString(params.Encode())
-	req, err := http.NewRequest("POST", cfg.QiscusConfig.BaseUrl+ASSIGN_AGENT_PATH, payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", qc.BaseUrl+ASSIGN_AGENT_PATH, payload)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Qiscus-App-Id", cfg.QiscusConfig.AppID)
-	req.Header.Set("Qiscus-Secret-Key", cfg.QiscusConfig.SecretKey)
+	req.Header.Set("Qiscus-App-Id", qc.AppID)
+	req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -347,6 +406,38 @@ func (wimr *WebhookIncomingMessageRequest) AssignAgent(agentID int) (*AssignAgen
 	return &response, nil
 }
 
+// RemoveAgent takes the agent out of the room.
+func (q *qiscusHTTP) RemoveAgent(ctx context.Context, roomID string, agentID int) error {
+	qc := q.conf()
+	client := q.client
+
+	params := url.Values{}
+	params.Set("room_id", roomID)
+	params.Set("agent_id", fmt.Sprintf("%d", agentID))
+
+	payload := bytes.NewBufferString(params.Encode())
+	req, err := http.NewRequestWithContext(ctx, "POST", qc.BaseUrl+REMOVE_AGENT_PATH, payload)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Qiscus-App-Id", qc.AppID)
+	req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to remove agent, status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
 type WebhookConfigResponse struct {
 	Data struct {
 		WebhookConfigs []struct {
@@ -361,15 +452,16 @@ type WebhookConfigResponse struct {
 	Status int `json:"status"`
 }
 
-func GetWebhookConfig(ctx context.Context) (*WebhookConfigResponse, error) {
-	client := &http.Client{}
+func (q *qiscusHTTP) GetWebhookConfig(ctx context.Context) (*WebhookConfigResponse, error) {
+	qc := q.conf()
+	client := q.client
 
-	req, err := http.NewRequest("GET", cfg.QiscusConfig.BaseUrl+GET_WEBHOOK_CONFIG_PATH, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", qc.BaseUrl+GET_WEBHOOK_CONFIG_PATH, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	token, err := getToken(ctx)
+	token, err := q.token(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -390,19 +482,21 @@ func GetWebhookConfig(ctx context.Context) (*WebhookConfigResponse, error) {
 
 	return &response, nil
 }
-func (wimr *WebhookIncomingMessageRequest) Resolve(message string) error {
-	client := &http.Client{}
 
-	encodedMessage := url.QueryEscape(message)
-	var data = strings.NewReader(fmt.Sprintf("room_id=%s&notes=%s&last_comment_id=%s", wimr.RoomID, encodedMessage, wimr.LatestService.LastCommentID))
+func (q *qiscusHTTP) Resolve(ctx context.Context, roomID, notes, lastCommentID string) error {
+	qc := q.conf()
+	client := q.client
 
-	req, err := http.NewRequest("POST", cfg.QiscusConfig.BaseUrl+MARK_AS_RESOLVED_PATH, data)
+	encodedNotes := url.QueryEscape(notes)
+	var data = strings.NewReader(fmt.Sprintf("room_id=%s&notes=%s&last_comment_id=%s", roomID, encodedNotes, lastCommentID))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", qc.BaseUrl+MARK_AS_RESOLVED_PATH, data)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Qiscus-App-Id", cfg.QiscusConfig.AppID)
-	req.Header.Set("Qiscus-Secret-Key", cfg.QiscusConfig.SecretKey)
+	req.Header.Set("Qiscus-App-Id", qc.AppID)
+	req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -415,6 +509,10 @@ func (wimr *WebhookIncomingMessageRequest) Resolve(message string) error {
 		return err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to mark as resolved, status code: %d", resp.StatusCode)
+	}
+
 	return nil
 }
 
@@ -488,6 +586,47 @@ type WebhookMarkAsResolvedRequest struct {
 	} `json:"customer"`
 }
 
+// flexString accepts both JSON strings and numbers, Qiscus sends ids as either
+type flexString string
+
+func (fs *flexString) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*fs = flexString(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+
+	*fs = flexString(n.String())
+	return nil
+}
+
+type WebhookNewMessageRequest struct {
+	Type    string `json:"type"`
+	Payload struct {
+		From struct {
+			ID    flexString `json:"id"`
+			Email string     `json:"email"`
+			Name  string     `json:"name"`
+		} `json:"from"`
+		Room struct {
+			ID   flexString `json:"id"`
+			Name string     `json:"name"`
+		} `json:"room"`
+		Message struct {
+			ID           flexString `json:"id"`
+			Type         string     `json:"type"`
+			Text         string     `json:"text"`
+			Timestamp    string     `json:"timestamp"`
+			UniqueTempID string     `json:"unique_temp_id"`
+		} `json:"message"`
+	} `json:"payload"`
+}
+
 type SetWebHookResponse struct {
 	Data struct {
 		ID                             int         `json:"id"`
@@ -515,8 +654,9 @@ type SetWebHookResponse struct {
 	} `json:"data"`
 }
 
-func SetWebHookMarkAsResolved(webhookUrl string) (*SetWebHookResponse, error) {
-	client := &http.Client{}
+func (q *qiscusHTTP) SetWebhookMarkAsResolved(ctx context.Context, webhookUrl string) (*SetWebHookResponse, error) {
+	qc := q.conf()
+	client := q.client
 
 	params := url.Values{}
 	params.Set("webhook_url", webhookUrl)
@@ -524,14 +664,14 @@ func SetWebHookMarkAsResolved(webhookUrl string) (*SetWebHookResponse, error) {
 
 	payload := bytes.NewBufferString(params.Encode())
 
-	req, err := http.NewRequest("POST", cfg.QiscusConfig.BaseUrl+SET_WEBHOOK_MARK_AS_RESOLVED, payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", qc.BaseUrl+SET_WEBHOOK_MARK_AS_RESOLVED, payload)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Qiscus-App-Id", cfg.QiscusConfig.AppID)
-	req.Header.Set("Qiscus-Secret-Key", cfg.QiscusConfig.SecretKey)
+	req.Header.Set("Qiscus-App-Id", qc.AppID)
+	req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -547,8 +687,9 @@ func SetWebHookMarkAsResolved(webhookUrl string) (*SetWebHookResponse, error) {
 	return &response, nil
 }
 
-func SetWebHookIncomingMessage(webhookUrl string) (*SetWebHookResponse, error) {
-	client := &http.Client{}
+func (q *qiscusHTTP) SetWebhookIncomingMessage(ctx context.Context, webhookUrl string) (*SetWebHookResponse, error) {
+	qc := q.conf()
+	client := q.client
 
 	params := url.Values{}
 	params.Set("webhook_url", webhookUrl)
@@ -556,14 +697,14 @@ func SetWebHookIncomingMessage(webhookUrl string) (*SetWebHookResponse, error) {
 
 	payload := bytes.NewBufferString(params.Encode())
 
-	req, err := http.NewRequest("POST", cfg.QiscusConfig.BaseUrl+SET_WEBHOOK_INCOMING_MESSAGE, payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", qc.BaseUrl+SET_WEBHOOK_INCOMING_MESSAGE, payload)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Qiscus-App-Id", cfg.QiscusConfig.AppID)
-	req.Header.Set("Qiscus-Secret-Key", cfg.QiscusConfig.SecretKey)
+	req.Header.Set("Qiscus-App-Id", qc.AppID)
+	req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -597,22 +738,23 @@ type AllocateAssignAgentResponse struct {
 	} `json:"data"`
 }
 
-func (wimr *WebhookIncomingMessageRequest) AllocateAssignAgent() (*AllocateAssignAgentResponse, error) {
-	client := &http.Client{}
+func (q *qiscusHTTP) AllocateAssignAgent(ctx context.Context, roomID string) (*AllocateAssignAgentResponse, error) {
+	qc := q.conf()
+	client := q.client
 
 	params := url.Values{}
-	params.Set("room_id", wimr.RoomID)
+	params.Set("room_id", roomID)
 	params.Set("ignore_agent_availability", "false")
 
 	payload := bytes.NewBufferString(params.Encode())
-	req, err := http.NewRequest("POST", cfg.QiscusConfig.BaseUrl+ALLOCATE_ASSIGN_AGENT_PATH, payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", qc.BaseUrl+ALLOCATE_ASSIGN_AGENT_PATH, payload)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Qiscus-App-Id", cfg.QiscusConfig.AppID)
-	req.Header.Set("Qiscus-Secret-Key", cfg.QiscusConfig.SecretKey)
+	req.Header.Set("Qiscus-App-Id", qc.AppID)
+	req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -631,3 +773,254 @@ func (wimr *WebhookIncomingMessageRequest) AllocateAssignAgent() (*AllocateAssig
 
 	return &response, nil
 }
+
+// Message types of SendMessage
+const (
+	MessageTypeText = "text"
+	// MessageTypeCustom carries a payload the channel renders itself
+	MessageTypeCustom = "custom"
+	// MessageTypeSystemEvent is shown in the room as a notice instead of a
+	// bubble from the bot
+	MessageTypeSystemEvent = "system_event"
+)
+
+type SendMessageRequest struct {
+	SenderEmail string         `json:"sender_email"`
+	Message     string         `json:"message"`
+	Type        string         `json:"type"`
+	RoomID      string         `json:"room_id"`
+	Payload     map[string]any `json:"payload,omitempty"`
+	// Extras are kept with the message, they are not shown
+	Extras map[string]any `json:"extras,omitempty"`
+}
+
+// SendBotMessage posts a text message into the room as the admin/bot account.
+func (q *qiscusHTTP) SendBotMessage(ctx context.Context, roomID, message string) error {
+	return q.SendMessage(ctx, &SendMessageRequest{
+		Message: message,
+		Type:    MessageTypeText,
+		RoomID:  roomID,
+	})
+}
+
+// SendMessage posts a message into the room. The sender defaults to the
+// admin/bot account and the type to text.
+func (q *qiscusHTTP) SendMessage(ctx context.Context, m *SendMessageRequest) error {
+	qc := q.conf()
+	client := q.client
+
+	msg := *m
+	if msg.SenderEmail == "" {
+		msg.SenderEmail = qc.Email
+	}
+	if msg.Type == "" {
+		msg.Type = MessageTypeText
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", qc.BaseUrl+fmt.Sprintf(SEND_BOT_MESSAGE_PATH, qc.AppID), bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Qiscus-App-Id", qc.AppID)
+	req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send message, status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Serve statuses of ListRooms
+const (
+	RoomsUnserved = "unserved"
+	RoomsServed   = "served"
+)
+
+// listRoomsPageSize is the limit of one ListRooms request.
+const listRoomsPageSize = 50
+
+// RoomAgent is an agent in a customer room.
+type RoomAgent struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// CustomerRoom is a room with its customer, its current session and the
+// agents in it.
+type CustomerRoom struct {
+	RoomID        string         `json:"room_id"`
+	ServiceID     int            `json:"service_id"`
+	Name          string         `json:"name"`
+	Source        string         `json:"source"`
+	UserID        string         `json:"user_id"`
+	UserAvatarURL string         `json:"user_avatar_url"`
+	Extras        map[string]any `json:"extras"`
+	IsResolved    bool           `json:"is_resolved"`
+	IsWaiting     bool           `json:"is_waiting"`
+	LastCommentID string         `json:"last_comment_id"`
+	Tags          []string       `json:"tags"`
+	Agents        []RoomAgent    `json:"agents"`
+	CreatedAt     time.Time      `json:"created_at"`
+}
+
+type GetRoomResponse struct {
+	Data struct {
+		CustomerRoom CustomerRoom `json:"customer_room"`
+	} `json:"data"`
+	Status int `json:"status"`
+}
+
+// GetRoom returns the room with its customer and agents, ErrNotFound when
+// Qiscus does not know it.
+func (q *qiscusHTTP) GetRoom(ctx context.Context, roomID string) (*CustomerRoom, error) {
+	qc := q.conf()
+	client := q.client
+
+	req, err := http.NewRequestWithContext(ctx, "GET", qc.BaseUrl+fmt.Sprintf(GET_ROOM_PATH, url.PathEscape(roomID)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Qiscus-App-Id", qc.AppID)
+	req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("room %s: %w", roomID, ErrNotFound)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get room, status code: %d", res.StatusCode)
+	}
+
+	var response GetRoomResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &response.Data.CustomerRoom, nil
+}
+
+type ListRoomsRequest struct {
+	Status      string `json:"status"`
+	ServeStatus string `json:"serve_status"`
+	Limit       int    `json:"limit"`
+	CursorAfter string `json:"cursor_after,omitempty"`
+}
+
+type ListRoomsResponse struct {
+	Data struct {
+		CustomerRooms []CustomerRoom `json:"customer_rooms"`
+	} `json:"data"`
+	Meta struct {
+		CursorAfter string `json:"cursor_after"`
+	} `json:"meta"`
+	Status int `json:"status"`
+}
+
+// ListRooms returns every unresolved room with the serve status, RoomsServed
+// for the ongoing rooms, oldest first. It follows the cursor until the last
+// page.
+func (q *qiscusHTTP) ListRooms(ctx context.Context, serveStatus string) ([]CustomerRoom, error) {
+	qc := q.conf()
+	client := q.client
+
+	rooms := []CustomerRoom{}
+	cursor := ""
+	for {
+		payload, err := json.Marshal(ListRoomsRequest{
+			Status:      "unresolved",
+			ServeStatus: serveStatus,
+			Limit:       listRoomsPageSize,
+			CursorAfter: cursor,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", qc.BaseUrl+LIST_ROOMS_PATH, bytes.NewBuffer(payload))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Qiscus-App-Id", qc.AppID)
+		req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var response ListRoomsResponse
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("failed to list %s rooms, status code: %d", serveStatus, res.StatusCode)
+		}
+		err = json.NewDecoder(res.Body).Decode(&response)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+
+		rooms = append(rooms, response.Data.CustomerRooms...)
+		if response.Meta.CursorAfter == "" || len(response.Data.CustomerRooms) == 0 {
+			return rooms, nil
+		}
+		cursor = response.Meta.CursorAfter
+	}
+}
+
+// AddRoomTags tags the room, tags it already has are kept once.
+func (q *qiscusHTTP) AddRoomTags(ctx context.Context, roomID string, tags ...string) error {
+	qc := q.conf()
+	client := q.client
+
+	for _, tag := range tags {
+		params := url.Values{}
+		params.Set("room_id", roomID)
+		params.Set("tag", tag)
+
+		payload := bytes.NewBufferString(params.Encode())
+		req, err := http.NewRequestWithContext(ctx, "POST", qc.BaseUrl+ADD_ROOM_TAG_PATH, payload)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Qiscus-App-Id", qc.AppID)
+		req.Header.Set("Qiscus-Secret-Key", qc.SecretKey)
+
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to add tag %q, status code: %d", tag, res.StatusCode)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memTokens is a TokenCache for tests.
+type memTokens struct {
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func (m *memTokens) Token(ctx context.Context, account string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[account]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return token, nil
+}
+
+func (m *memTokens) SetToken(ctx context.Context, account, token string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tokens == nil {
+		m.tokens = map[string]string{}
+	}
+	m.tokens[account] = token
+	return nil
+}
+
+// newTestQiscus serves a fake without webhooks and returns a client of it.
+func newTestQiscus(t *testing.T, agents ...fakeAgentConfig) (*FakeQiscus, *qiscusHTTP) {
+	t.Helper()
+
+	qc := qiscusConfig{AppID: "test-app", SecretKey: "secret", Email: "admin@fake.qiscus", Password: "password"}
+	f := NewFakeQiscus(qc, "", agents)
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	qc.BaseUrl = srv.URL
+	return f, newQiscusHTTP(func() qiscusConfig { return qc }, &memTokens{})
+}
+
+func fakeRoom(t *testing.T, f *FakeQiscus, roomID string) FakeRoom {
+	t.Helper()
+
+	for _, room := range f.State().Rooms {
+		if room.ID == roomID {
+			return room
+		}
+	}
+	t.Fatalf("room %s not in the fake", roomID)
+	return FakeRoom{}
+}
+
+func TestQiscusSendMessage(t *testing.T) {
+	ctx := context.Background()
+	f, q := newTestQiscus(t)
+	room := f.NewRoom("wa", "Jane", "jane@example.com")
+
+	if err := q.SendBotMessage(ctx, room.ID, "Hello"); err != nil {
+		t.Fatalf("SendBotMessage: %v", err)
+	}
+	err := q.SendMessage(ctx, &SendMessageRequest{
+		RoomID:  room.ID,
+		Type:    MessageTypeSystemEvent,
+		Message: "Agent joined",
+		Extras:  map[string]any{"queue_position": 2},
+	})
+	if err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+
+	messages := f.State().BotMessages
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(messages))
+	}
+	if m := messages[0]; m.RoomID != room.ID || m.Type != MessageTypeText || m.Message != "Hello" {
+		t.Errorf("bot message = %+v", m)
+	}
+	if m := messages[1]; m.Type != MessageTypeSystemEvent || m.Message != "Agent joined" || m.Extras["queue_position"] != float64(2) {
+		t.Errorf("system message = %+v", m)
+	}
+
+	if err := q.SendMessage(ctx, &SendMessageRequest{RoomID: room.ID, Type: "carousel", Message: "x"}); err == nil {
+		t.Error("SendMessage with an unknown type succeeded")
+	}
+	if err := q.SendBotMessage(ctx, "missing", "Hello"); err == nil {
+		t.Error("SendBotMessage to an unknown room succeeded")
+	}
+}
+
+func TestQiscusRemoveAgent(t *testing.T) {
+	ctx := context.Background()
+	f, q := newTestQiscus(t, fakeAgentConfig{ID: 1, Online: true}, fakeAgentConfig{ID: 2, Online: true})
+	room := f.NewRoom("wa", "Jane", "jane@example.com")
+
+	if _, err := q.AssignAgent(ctx, room.ID, 1); err != nil {
+		t.Fatalf("AssignAgent: %v", err)
+	}
+
+	// Removing an agent that is not in the room changes nothing
+	if err := q.RemoveAgent(ctx, room.ID, 2); err != nil {
+		t.Fatalf("RemoveAgent of another agent: %v", err)
+	}
+	if got := fakeRoom(t, f, room.ID).AgentID; got != 1 {
+		t.Fatalf("agent after removing another one = %d, want 1", got)
+	}
+
+	if err := q.RemoveAgent(ctx, room.ID, 1); err != nil {
+		t.Fatalf("RemoveAgent: %v", err)
+	}
+	if got := fakeRoom(t, f, room.ID).AgentID; got != 0 {
+		t.Errorf("agent after remove = %d, want 0", got)
+	}
+	for _, a := range f.State().Agents {
+		if a.CurrentCustomerCount != 0 {
+			t.Errorf("agent %d still has %d customers", a.ID, a.CurrentCustomerCount)
+		}
+	}
+
+	if err := q.RemoveAgent(ctx, "missing", 1); err == nil {
+		t.Error("RemoveAgent from an unknown room succeeded")
+	}
+}
+
+func TestQiscusGetRoom(t *testing.T) {
+	ctx := context.Background()
+	f, q := newTestQiscus(t, fakeAgentConfig{ID: 1, Name: "Ann", Online: true})
+	room := f.NewRoom("wa", "Jane", "jane@example.com")
+
+	got, err := q.GetRoom(ctx, room.ID)
+	if err != nil {
+		t.Fatalf("GetRoom: %v", err)
+	}
+	if got.RoomID != room.ID || got.ServiceID != room.ServiceID || got.Name != "Jane" || got.UserID != "jane@example.com" || got.Source != "wa" {
+		t.Errorf("room = %+v", got)
+	}
+	if !got.IsWaiting || got.IsResolved || len(got.Agents) != 0 {
+		t.Errorf("new room is not waiting without agents: %+v", got)
+	}
+	if got.CreatedAt.IsZero() {
+		t.Error("room has no created_at")
+	}
+
+	if _, err := q.AssignAgent(ctx, room.ID, 1); err != nil {
+		t.Fatalf("AssignAgent: %v", err)
+	}
+	got, err = q.GetRoom(ctx, room.ID)
+	if err != nil {
+		t.Fatalf("GetRoom: %v", err)
+	}
+	if got.IsWaiting || len(got.Agents) != 1 || got.Agents[0].ID != 1 || got.Agents[0].Name != "Ann" {
+		t.Errorf("assigned room = %+v", got)
+	}
+
+	if _, err := q.GetRoom(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRoom of an unknown room: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestQiscusAddRoomTags(t *testing.T) {
+	ctx := context.Background()
+	f, q := newTestQiscus(t)
+	room := f.NewRoom("wa", "Jane", "jane@example.com")
+
+	if err := q.AddRoomTags(ctx, room.ID, "vip", "billing"); err != nil {
+		t.Fatalf("AddRoomTags: %v", err)
+	}
+	if err := q.AddRoomTags(ctx, room.ID, "vip"); err != nil {
+		t.Fatalf("AddRoomTags again: %v", err)
+	}
+
+	if got, want := fakeRoom(t, f, room.ID).Tags, []string{"vip", "billing"}; !slices.Equal(got, want) {
+		t.Errorf("tags = %v, want %v", got, want)
+	}
+
+	got, err := q.GetRoom(ctx, room.ID)
+	if err != nil {
+		t.Fatalf("GetRoom: %v", err)
+	}
+	if want := []string{"vip", "billing"}; !slices.Equal(got.Tags, want) {
+		t.Errorf("tags of GetRoom = %v, want %v", got.Tags, want)
+	}
+
+	if err := q.AddRoomTags(ctx, room.ID, " "); err == nil {
+		t.Error("AddRoomTags with an empty tag succeeded")
+	}
+	if err := q.AddRoomTags(ctx, "missing", "vip"); err == nil {
+		t.Error("AddRoomTags to an unknown room succeeded")
+	}
+}
+
+func TestQiscusListRooms(t *testing.T) {
+	ctx := context.Background()
+	f, q := newTestQiscus(t, fakeAgentConfig{ID: 1, Online: true})
+
+	// More than a page of rooms, every third one served and one resolved
+	var unserved, served []string
+	for i := range 2*listRoomsPageSize + 10 {
+		room := f.NewRoom("wa", "Customer", "customer@example.com")
+
+		switch {
+		case i == 4:
+			if err := q.Resolve(ctx, room.ID, "", room.LastCommentID); err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+		case i%3 == 0:
+			if _, err := q.AssignAgent(ctx, room.ID, 1); err != nil {
+				t.Fatalf("AssignAgent: %v", err)
+			}
+			served = append(served, room.ID)
+		default:
+			unserved = append(unserved, room.ID)
+		}
+	}
+
+	ids := func(rooms []CustomerRoom) []string {
+		out := []string{}
+		for _, r := range rooms {
+			out = append(out, r.RoomID)
+		}
+		return out
+	}
+
+	rooms, err := q.ListRooms(ctx, RoomsUnserved)
+	if err != nil {
+		t.Fatalf("ListRooms unserved: %v", err)
+	}
+	if got := ids(rooms); !slices.Equal(got, unserved) {
+		t.Errorf("unserved rooms = %v, want %v", got, unserved)
+	}
+
+	rooms, err = q.ListRooms(ctx, RoomsServed)
+	if err != nil {
+		t.Fatalf("ListRooms served: %v", err)
+	}
+	if got := ids(rooms); !slices.Equal(got, served) {
+		t.Errorf("served rooms = %v, want %v", got, served)
+	}
+	for _, r := range rooms {
+		if len(r.Agents) != 1 || r.Agents[0].ID != 1 {
+			t.Errorf("served room %s has agents %+v", r.RoomID, r.Agents)
+		}
+	}
+}
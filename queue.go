@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"strconv"
+	"time"
 
 	"github.com/hibiken/asynq"
 )
@@ -19,109 +23,356 @@ func NewQueueConfig(redisURL string) *QueueConfig {
 	}
 }
 
+// asynqQueue is the TaskQueue on asynq, shared by every tenant.
+type asynqQueue struct {
+	client    *asynq.Client
+	inspector *asynq.Inspector
+}
+
+func newAsynqQueue(client *asynq.Client, inspector *asynq.Inspector) *asynqQueue {
+	return &asynqQueue{client: client, inspector: inspector}
+}
+
+func (q *asynqQueue) Enqueue(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+	return q.client.EnqueueContext(ctx, task, opts...)
+}
+
+func (q *asynqQueue) GetQueueInfo(queue string) (*asynq.QueueInfo, error) {
+	return q.inspector.GetQueueInfo(queue)
+}
+
+func (q *asynqQueue) ListTasks(queue, state string, opts ...asynq.ListOption) ([]*asynq.TaskInfo, error) {
+	switch state {
+	case "pending":
+		return q.inspector.ListPendingTasks(queue, opts...)
+	case "active":
+		return q.inspector.ListActiveTasks(queue, opts...)
+	case "scheduled":
+		return q.inspector.ListScheduledTasks(queue, opts...)
+	case "retry":
+		return q.inspector.ListRetryTasks(queue, opts...)
+	case "archived":
+		return q.inspector.ListArchivedTasks(queue, opts...)
+	}
+
+	return nil, fmt.Errorf("unknown task state %q", state)
+}
+
+func (q *asynqQueue) DeleteTask(queue, taskID string) error {
+	return q.inspector.DeleteTask(queue, taskID)
+}
+
+func (q *asynqQueue) PauseQueue(queue string) error {
+	return q.inspector.PauseQueue(queue)
+}
+
+func (q *asynqQueue) UnpauseQueue(queue string) error {
+	return q.inspector.UnpauseQueue(queue)
+}
+
 const TypeChatAssignAgent = "chat:assign_agent"
 
-func NewChatAssignAgentTask(wimr *WebhookIncomingMessageRequest) (*asynq.Task, error) {
+func (s *Service) NewChatAssignAgentTask(wimr *WebhookIncomingMessageRequest) (*asynq.Task, error) {
 	payload, err := json.Marshal(wimr)
 	if err != nil {
 		return nil, err
 	}
 
-	return asynq.NewTask(TypeChatAssignAgent, payload), nil
+	t := s.conf()
+	qc := t.QueueConfig
+	return asynq.NewTask(TypeChatAssignAgent, payload,
+		asynq.Queue(t.queue(QUEUE_DEFAULT)),
+		asynq.MaxRetry(int(qc.MaxRetry)),
+		asynq.Timeout(qc.Timeout),
+		asynq.Deadline(time.Now().Add(qc.Deadline)),
+	), nil
+}
+
+// EnqueueChatAssignAgent queues the room for allocation and remembers when
+// it started waiting.
+func (s *Service) EnqueueChatAssignAgent(ctx context.Context, wimr *WebhookIncomingMessageRequest) error {
+	return s.enqueueChatAssignAgent(ctx, wimr, time.Now())
+}
+
+// enqueueChatAssignAgent queues a room that started waiting at arrivedAt.
+// The queue deadline still counts from now.
+func (s *Service) enqueueChatAssignAgent(ctx context.Context, wimr *WebhookIncomingMessageRequest, arrivedAt time.Time) error {
+	task, err := s.NewChatAssignAgentTask(wimr)
+	if err != nil {
+		return fmt.Errorf("Failed to create task: %w", err)
+	}
+
+	info, err := s.Queue.Enqueue(ctx, task)
+	if err != nil {
+		return fmt.Errorf("could not enqueue task: %w", err)
+	}
+	fmt.Printf("enqueued task: id=%s queue=%s", info.ID, info.Queue)
+
+	err = s.Rooms.SetEnqueuedAt(ctx, wimr.RoomID, time.Now())
+	if err != nil {
+		log.Printf("Failed to set enqueued_at of room %s: %v", wimr.RoomID, err)
+	}
+	err = s.Rooms.SetArrivedAt(ctx, wimr.RoomID, arrivedAt)
+	if err != nil {
+		log.Printf("Failed to set arrived_at of room %s: %v", wimr.RoomID, err)
+	}
+
+	s.PublishEvent(ctx, Event{Type: EventRoomEnqueued, RoomID: wimr.RoomID})
+
+	// The webhook does not wait on Qiscus for the message
+	go func() {
+		msgCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), qiscusTimeout)
+		defer cancel()
+
+		if err := s.SendEnqueuedMessage(msgCtx, wimr); err != nil {
+			log.Printf("Failed to send queue message to room %s: %v", wimr.RoomID, err)
+		}
+	}()
+
+	return nil
 }
 
-func HandleChatAssignAgentTask(ctx context.Context, task *asynq.Task) (err error) {
+// RetryDelay backs chat:assign_agent retries of the tenant off
+// exponentially from backoff.initial up to backoff.max. Other tasks use the
+// asynq default.
+func (s *Service) RetryDelay() asynq.RetryDelayFunc {
+	return func(n int, err error, task *asynq.Task) time.Duration {
+		if task.Type() != TypeChatAssignAgent {
+			return asynq.DefaultRetryDelayFunc(n, err, task)
+		}
+
+		b := s.conf().QueueConfig.Backoff
+		delay := float64(b.Initial) * math.Pow(b.Factor, float64(n))
+		if delay > float64(b.Max) {
+			return b.Max
+		}
+
+		return time.Duration(delay)
+	}
+}
+
+func isLastAttempt(ctx context.Context) bool {
+	retried, ok := asynq.GetRetryCount(ctx)
+	if !ok {
+		return false
+	}
+
+	maxRetry, ok := asynq.GetMaxRetry(ctx)
+	if !ok {
+		return false
+	}
+
+	return retried >= maxRetry
+}
+
+func (s *Service) isRoomDeadlineExceeded(ctx context.Context, roomID string) bool {
+	enqueuedAt, err := s.Rooms.EnqueuedAt(ctx, roomID)
+	if err != nil {
+		return false
+	}
+
+	return time.Since(enqueuedAt) >= s.conf().QueueConfig.Deadline
+}
+
+// RunAssignFallback is called once a room ran out of attempts or time
+// without getting an agent.
+func (s *Service) RunAssignFallback(ctx context.Context, wimr *WebhookIncomingMessageRequest, cause error) {
+	fallback := s.conf().QueueConfig.Fallback
+
+	log.Printf("Room %s could not be assigned (%v), running fallback %q", wimr.RoomID, cause, fallback.Action)
+
+	switch fallback.Action {
+	case "auto_reply":
+		if fallback.Message == "" {
+			return
+		}
+		if err := s.Qiscus.SendBotMessage(ctx, wimr.RoomID, fallback.Message); err != nil {
+			log.Printf("Error sending fallback message to room %s: %v", wimr.RoomID, err)
+		}
+	case "escalate":
+		s.PublishEvent(ctx, Event{Type: EventRoomEscalated, RoomID: wimr.RoomID})
+	}
+}
+
+// assignFallbackTimeout bounds the fallback, it runs after the attempt's
+// own deadline.
+const assignFallbackTimeout = 30 * time.Second
+
+// failAssign ends a failed attempt. On the last attempt, or once the room
+// waited past the deadline, the fallback runs and the task is not retried.
+func (s *Service) failAssign(ctx context.Context, wimr *WebhookIncomingMessageRequest, cause error) error {
+	// The attempt context may already be done at this point
+	fallbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), assignFallbackTimeout)
+	defer cancel()
+
+	if isLastAttempt(ctx) || s.isRoomDeadlineExceeded(fallbackCtx, wimr.RoomID) {
+		s.RunAssignFallback(fallbackCtx, wimr, cause)
+		return fmt.Errorf("%v: %w", cause, asynq.SkipRetry)
+	}
+	return cause
+}
+
+// undoAssign takes the agent off a room whose assignment could not be
+// recorded, so the retry or the fallback starts from a room without an
+// agent. taken tells whether the room already took a slot of the agent in
+// Redis.
+func (s *Service) undoAssign(ctx context.Context, wimr *WebhookIncomingMessageRequest, agentID int, taken bool) {
+	// The attempt context may already be done at this point
+	undoCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), assignFallbackTimeout)
+	defer cancel()
+
+	if err := s.Qiscus.RemoveAgent(undoCtx, wimr.RoomID, agentID); err != nil {
+		log.Printf("Error removing agent %d from room %s after a failed assignment: %v", agentID, wimr.RoomID, err)
+	}
+
+	if !taken {
+		return
+	}
+
+	agentIDStr := strconv.Itoa(agentID)
+	count, err := s.Agents.ReleaseRoom(undoCtx, wimr.RoomID, wimr.LatestService.ID, agentIDStr)
+	if err != nil {
+		log.Printf("Error giving back the slot of agent %d for room %s: %v", agentID, wimr.RoomID, err)
+		return
+	}
+	s.PublishCustomerCount(undoCtx, agentIDStr, count)
+}
+
+func (s *Service) HandleChatAssignAgentTask(ctx context.Context, task *asynq.Task) (err error) {
 	var wimr WebhookIncomingMessageRequest
 	if err = json.Unmarshal(task.Payload(), &wimr); err != nil {
 		return err
 	}
 
-	tx, err := pool.Begin(ctx)
+	if s.isRoomAbandoned(ctx, &wimr) {
+		log.Printf("Room %s was resolved while waiting, dropping it", wimr.RoomID)
+		s.recordAbandonedChat(ctx, &wimr)
+		return nil
+	}
+
+	// The attempt may have run out of time before it got here
+	if err := ctx.Err(); err != nil {
+		return s.failAssign(ctx, &wimr, err)
+	}
+
+	tx, err := s.Chats.Begin(ctx)
 	if err != nil {
-		return err
+		return s.failAssign(ctx, &wimr, err)
 	}
 
-	isChatRoomExists, err := IsChatRoomExists(ctx, tx, wimr.RoomID)
+	// A resolved room that is re-opened comes back with a new session
+	isChatSessionExists, err := tx.IsChatSessionExists(ctx, wimr.RoomID, wimr.LatestService.ID)
 	if err != nil {
-		fmt.Println("Error checking if chat room exists:", err)
+		fmt.Println("Error checking if chat session exists:", err)
 		tx.Rollback(ctx)
-		return err
+		return s.failAssign(ctx, &wimr, err)
 	}
 
-	if isChatRoomExists {
-		fmt.Println(fmt.Sprintf("Chat room %s already exists, skipping creation", wimr.RoomID))
+	if isChatSessionExists {
+		fmt.Println(fmt.Sprintf("Chat room %s session %d already exists, skipping creation", wimr.RoomID, wimr.LatestService.ID))
 		tx.Rollback(ctx)
 		return nil
 	}
 
-	err = CreateChat(ctx, tx, &wimr)
+	err = tx.CreateChat(ctx, &wimr)
 	if err != nil {
 		fmt.Println("Error creating chat:", err)
 		tx.Rollback(ctx)
-		return err
+		return s.failAssign(ctx, &wimr, err)
 	}
 
-	availableAgentID, err := GetAvailableAgentWithCustomerCount(ctx, wimr.RoomID, int(cfg.WebhookConfig.MaxCurrentCustomer))
-	if err != nil {
-		fmt.Println("Error find available agent:", err)
+	availableAgentIDInt, explanation, err := s.AllocateAgent(ctx, &wimr)
+	if errors.Is(err, errRoomAbandoned) {
+		log.Printf("Room %s was resolved while waiting for an agent, dropping it", wimr.RoomID)
 		tx.Rollback(ctx)
-		return err
+		s.recordAbandonedChat(ctx, &wimr)
+		return nil
 	}
-
-	availableAgentIDInt, err := strconv.Atoi(availableAgentID)
 	if err != nil {
-		fmt.Println("Error parsing available agent id:", err)
+		fmt.Println("Error allocating agent:", err)
 		tx.Rollback(ctx)
-		return err
+		return s.failAssign(ctx, &wimr, err)
 	}
+	availableAgentID := strconv.Itoa(availableAgentIDInt)
 
-	_, err = wimr.AssignAgent(availableAgentIDInt)
-	if err != nil {
-		fmt.Println("Error allocating agent:", err)
+	// Resolved while the agent was assigned, keep their slot free
+	if s.isRoomAbandoned(ctx, &wimr) {
+		log.Printf("Room %s was resolved while agent %d was assigned, dropping it", wimr.RoomID, availableAgentIDInt)
 		tx.Rollback(ctx)
-		return err
+		s.recordAbandonedChat(ctx, &wimr)
+		return nil
 	}
 
-	customerCountKey := fmt.Sprintf("agent:%s:customer_count", availableAgentID)
-	err = rdb.Incr(ctx, customerCountKey).Err()
+	err = tx.CreateAssignment(ctx, &Assignment{
+		RoomID:      wimr.RoomID,
+		ServiceID:   wimr.LatestService.ID,
+		AgentID:     availableAgentIDInt,
+		Kind:        AssignmentKindAssign,
+		Actor:       "allocator:" + s.conf().Allocation.Backend,
+		Explanation: explanation,
+	})
 	if err != nil {
-		fmt.Println("Error increasing customer count:", err)
+		fmt.Println("Error recording assignment:", err)
 		tx.Rollback(ctx)
-		return err
+		s.undoAssign(ctx, &wimr, availableAgentIDInt, false)
+		return s.failAssign(ctx, &wimr, err)
+	}
+
+	if s.conf().Shifts.Enabled {
+		err = tx.IncrementShiftAssignedChats(ctx, availableAgentIDInt, time.Now())
+		if err != nil {
+			fmt.Println("Error counting shift chats:", err)
+			tx.Rollback(ctx)
+			s.undoAssign(ctx, &wimr, availableAgentIDInt, false)
+			return s.failAssign(ctx, &wimr, err)
+		}
 	}
 
-	roomAgentKey := fmt.Sprintf("room:%s:agent", wimr.RoomID)
-	err = rdb.Set(ctx, roomAgentKey, availableAgentID, 0).Err()
+	customerCount, err := s.Agents.AssignRoom(ctx, wimr.RoomID, wimr.LatestService.ID, availableAgentID)
 	if err != nil {
-		fmt.Println("Error set room agent:", err)
+		fmt.Println("Error assigning room to agent:", err)
 		tx.Rollback(ctx)
-		return err
+		s.undoAssign(ctx, &wimr, availableAgentIDInt, false)
+		return s.failAssign(ctx, &wimr, err)
 	}
 
-	err = UpdateChat(ctx, tx, &wimr)
+	err = tx.UpdateChat(ctx, &wimr)
 	if err != nil {
 		fmt.Println("Error updating chat:", err)
 		tx.Rollback(ctx)
-		return
+		s.undoAssign(ctx, &wimr, availableAgentIDInt, true)
+		return s.failAssign(ctx, &wimr, err)
 	}
 
-	// go func() {
-	// 	delay := time.Duration(5+rand.Intn(6)) * time.Second
-
-	// 	log.Printf("Waiting %s before resolving chat %s", delay, wimr.RoomID)
-	// 	time.Sleep(delay)
-
-	// 	wimr.Resolve("This is a test message to mark as resolved")
-	// 	log.Printf("Room %s resolved", wimr.RoomID)
-	// }()
-
 	err = tx.Commit(ctx)
 	if err != nil {
 		fmt.Println("Error committing transaction:", err)
-		return err
+		s.undoAssign(ctx, &wimr, availableAgentIDInt, true)
+		return s.failAssign(ctx, &wimr, err)
 	}
 
 	println("Handling chat assign agent task for:", wimr.RoomID)
 
+	if err := s.StartIdleTracking(ctx, wimr.RoomID); err != nil {
+		log.Printf("Error starting idle tracking of room %s: %v", wimr.RoomID, err)
+	}
+	if err := s.StartFirstResponseSLA(ctx, wimr.RoomID, wimr.LatestService.ID, wimr.Source, availableAgentIDInt); err != nil {
+		log.Printf("Error starting first response SLA of room %s: %v", wimr.RoomID, err)
+	}
+
+	var waitSeconds float64
+	arrivedAt, err := s.Rooms.ArrivedAt(ctx, wimr.RoomID)
+	if err == nil {
+		waitSeconds = time.Since(arrivedAt).Seconds()
+	}
+
+	s.PublishEvent(ctx, Event{
+		Type:        EventRoomAssigned,
+		RoomID:      wimr.RoomID,
+		AgentID:     availableAgentID,
+		WaitSeconds: waitSeconds,
+	})
+	s.PublishCustomerCount(ctx, availableAgentID, customerCount)
+
 	return nil
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+func (m *memRooms) IsAbandoned(ctx context.Context, roomID string, serviceID int) (bool, error) {
+	return false, nil
+}
+
+func (m *memRooms) EnqueuedAt(ctx context.Context, roomID string) (time.Time, error) {
+	return time.Time{}, ErrNotFound
+}
+
+// memChats hands out transactions that fail at the step named by failAt.
+type memChats struct {
+	ChatRepository
+
+	failAt    string
+	committed int
+}
+
+func (m *memChats) Begin(ctx context.Context) (ChatTx, error) {
+	return &memChatTx{chats: m}, nil
+}
+
+type memChatTx struct {
+	chats *memChats
+}
+
+func (tx *memChatTx) fail(step string) error {
+	if tx.chats.failAt == step {
+		return errors.New(step + " failed")
+	}
+	return nil
+}
+
+func (tx *memChatTx) IsChatSessionExists(ctx context.Context, roomID string, serviceID int) (bool, error) {
+	return false, nil
+}
+
+func (tx *memChatTx) CreateChat(ctx context.Context, wimr *WebhookIncomingMessageRequest) error {
+	return tx.fail("CreateChat")
+}
+
+func (tx *memChatTx) UpdateChat(ctx context.Context, wimr *WebhookIncomingMessageRequest) error {
+	return tx.fail("UpdateChat")
+}
+
+func (tx *memChatTx) CreateAssignment(ctx context.Context, a *Assignment) error {
+	return tx.fail("CreateAssignment")
+}
+
+func (tx *memChatTx) CreateShift(ctx context.Context, shift *AgentShift) error {
+	return nil
+}
+
+func (tx *memChatTx) IncrementShiftAssignedChats(ctx context.Context, agentID int, now time.Time) error {
+	return tx.fail("IncrementShiftAssignedChats")
+}
+
+func (tx *memChatTx) Commit(ctx context.Context) error {
+	if err := tx.fail("Commit"); err != nil {
+		return err
+	}
+	tx.chats.committed++
+	return nil
+}
+
+func (tx *memChatTx) Rollback(ctx context.Context) error {
+	return nil
+}
+
+// TestAssignUndoneWhenNotRecorded fails the assign task after the agent was
+// assigned in Qiscus and checks the room is back without an agent.
+func TestAssignUndoneWhenNotRecorded(t *testing.T) {
+	for _, step := range []string{"CreateAssignment", "UpdateChat", "Commit"} {
+		t.Run(step, func(t *testing.T) {
+			ctx := context.Background()
+			s, agents, _, _ := newTestService(t)
+
+			f, q := newTestQiscus(t, fakeAgentConfig{ID: 1, Online: true})
+			s.Qiscus = q
+			s.Chats = &memChats{failAt: step}
+
+			agents.AddAgent(ctx, "1", nil)
+			agents.SetOnline(ctx, "1", true)
+			agents.SetCustomerCount(ctx, "1", 0)
+
+			room := f.NewRoom("wa", "Jane", "jane@example.com")
+			var wimr WebhookIncomingMessageRequest
+			wimr.RoomID = room.ID
+			wimr.Source = room.Source
+			wimr.LatestService.ID = room.ServiceID
+			payload, _ := json.Marshal(wimr)
+
+			err := s.HandleChatAssignAgentTask(ctx, asynq.NewTask(TypeChatAssignAgent, payload))
+			if err == nil {
+				t.Fatal("assign task succeeded")
+			}
+
+			if got := fakeRoom(t, f, room.ID).AgentID; got != 0 {
+				t.Errorf("agent %d still in the room after the failed assignment", got)
+			}
+			if count, _ := agents.CustomerCount(ctx, "1"); count != 0 {
+				t.Errorf("customer count = %d, want 0", count)
+			}
+			if _, err := agents.RoomAgent(ctx, room.ID); !errors.Is(err, ErrNotFound) {
+				t.Errorf("room still mapped: err = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// queueMessageTick is how often the worker looks for rooms due a waiting
+// message, queue_messages.interval is counted per room.
+const queueMessageTick = 15 * time.Second
+
+// queueMessageData is what the queue message templates can use.
+type queueMessageData struct {
+	Name     string
+	Source   string
+	Position int
+	// Wait is only meaningful when WaitKnown, nobody resolved a room in the
+	// window otherwise
+	Wait        time.Duration
+	WaitKnown   bool
+	WaitMinutes int
+}
+
+// parseQueueMessage parses the template and runs it once, so a template
+// using unknown fields fails when the config is loaded.
+func parseQueueMessage(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	sample := queueMessageData{Name: "Customer", Source: "qiscus", Position: 3, Wait: 5 * time.Minute, WaitKnown: true, WaitMinutes: 5}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// estimateWait guesses how long the room at position waits. The free slots
+// of the online agents take the first rooms right away, the rest get an
+// agent as fast as rooms were resolved during the window.
+func (s *Service) estimateWait(ctx context.Context, position int) (time.Duration, bool, error) {
+	maxCustomerCount := int(s.conf().WebhookConfig.MaxCurrentCustomer)
+
+	agentIDs, err := s.Agents.AgentIDs(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+
+	onShift, err := s.onShiftAgents(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+
+	draining, err := s.Agents.DrainingAgents(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+
+	free := 0
+	for _, id := range agentIDs {
+		if _, ok := draining[id]; ok || !isOnShift(onShift, id) {
+			continue
+		}
+
+		isOnline, err := s.Agents.IsOnline(ctx, id)
+		if err != nil {
+			return 0, false, err
+		}
+		if !isOnline {
+			continue
+		}
+
+		count, err := s.Agents.CustomerCount(ctx, id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return 0, false, err
+		}
+		if count >= 0 && count < maxCustomerCount {
+			free += maxCustomerCount - count
+		}
+	}
+
+	if position <= free {
+		return 0, true, nil
+	}
+
+	window := s.conf().QueueMessages.Window
+	resolves, err := s.Rooms.ResolvesSince(ctx, time.Now().Add(-window))
+	if err != nil {
+		return 0, false, err
+	}
+	if resolves == 0 {
+		return 0, false, nil
+	}
+
+	perRoom := window / time.Duration(resolves)
+	return time.Duration(position-free) * perRoom, true, nil
+}
+
+// sendQueueMessage renders the template for the room at position and sends
+// it, unless the channel opted out or a rate limit is hit. It reports
+// whether the message was sent.
+func (s *Service) sendQueueMessage(ctx context.Context, wimr *WebhookIncomingMessageRequest, name, text string, position int) (bool, error) {
+	qm := s.conf().QueueMessages
+	if !qm.Enabled || text == "" {
+		return false, nil
+	}
+	if slices.ContainsFunc(qm.DisabledChannels, func(ch string) bool { return strings.EqualFold(ch, wimr.Source) }) {
+		return false, nil
+	}
+
+	now := time.Now()
+	serviceID := wimr.LatestService.ID
+
+	count, last, err := s.Rooms.QueueMessages(ctx, wimr.RoomID, serviceID)
+	if err != nil {
+		return false, err
+	}
+	if qm.MaxPerRoom > 0 && count >= int(qm.MaxPerRoom) {
+		return false, nil
+	}
+	if !last.IsZero() && now.Sub(last) < qm.MinGap {
+		return false, nil
+	}
+
+	tmpl, err := parseQueueMessage(name, text)
+	if err != nil {
+		return false, fmt.Errorf("queue_messages.%s: %w", name, err)
+	}
+
+	data := queueMessageData{Name: wimr.Name, Source: wimr.Source, Position: position}
+	data.Wait, data.WaitKnown, err = s.estimateWait(ctx, position)
+	if err != nil {
+		log.Printf("Error estimating wait of room %s: %v", wimr.RoomID, err)
+	}
+	data.WaitMinutes = max(1, int(math.Ceil(data.Wait.Minutes())))
+
+	var message strings.Builder
+	if err := tmpl.Execute(&message, data); err != nil {
+		return false, err
+	}
+
+	if qm.MaxPerMinute > 0 {
+		sent, err := s.Rooms.TakeQueueMessage(ctx, now)
+		if err != nil {
+			return false, err
+		}
+		if sent > int(qm.MaxPerMinute) {
+			log.Printf("Queue message to room %s dropped, %d sent this minute", wimr.RoomID, qm.MaxPerMinute)
+			return false, nil
+		}
+	}
+
+	err = s.Qiscus.SendMessage(ctx, &SendMessageRequest{
+		RoomID:  wimr.RoomID,
+		Message: message.String(),
+		Type:    MessageTypeText,
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error sending queue message: %w", err)
+	}
+
+	if err := s.Rooms.RecordQueueMessage(ctx, wimr.RoomID, serviceID, now); err != nil {
+		log.Printf("Error recording queue message of room %s: %v", wimr.RoomID, err)
+	}
+
+	return true, nil
+}
+
+// SendEnqueuedMessage tells the customer of a room that just joined the
+// queue their position and estimated wait.
+func (s *Service) SendEnqueuedMessage(ctx context.Context, wimr *WebhookIncomingMessageRequest) error {
+	qm := s.conf().QueueMessages
+	if !qm.Enabled || qm.Enqueued == "" {
+		return nil
+	}
+
+	// The room is the last of everything waiting
+	position := 0
+	for _, queue := range s.assignQueues() {
+		info, err := s.Queue.GetQueueInfo(queue)
+		if err != nil {
+			if errors.Is(err, asynq.ErrQueueNotFound) {
+				continue
+			}
+			return err
+		}
+		position += info.Pending + info.Active + info.Scheduled + info.Retry
+	}
+
+	_, err := s.sendQueueMessage(ctx, wimr, "enqueued", qm.Enqueued, max(position, 1))
+	return err
+}
+
+// waitingRooms lists the rooms waiting for an agent in the order they will
+// get one: the rooms being allocated, the pending ones of the priority queue
+// before the default one, then the retries.
+func (s *Service) waitingRooms() ([]*WebhookIncomingMessageRequest, error) {
+	const pageSize = 100
+
+	list := func(queue, state string) ([]*asynq.TaskInfo, error) {
+		var all []*asynq.TaskInfo
+		for page := 1; ; page++ {
+			tasks, err := s.Queue.ListTasks(queue, state, asynq.Page(page), asynq.PageSize(pageSize))
+			if err != nil {
+				if errors.Is(err, asynq.ErrQueueNotFound) {
+					return all, nil
+				}
+				return nil, err
+			}
+
+			all = append(all, tasks...)
+			if len(tasks) < pageSize {
+				return all, nil
+			}
+		}
+	}
+
+	var ordered, later []*asynq.TaskInfo
+	for _, state := range []string{"active", "pending"} {
+		for _, queue := range s.assignQueues() {
+			tasks, err := list(queue, state)
+			if err != nil {
+				return nil, err
+			}
+			ordered = append(ordered, tasks...)
+		}
+	}
+	for _, state := range []string{"scheduled", "retry"} {
+		for _, queue := range s.assignQueues() {
+			tasks, err := list(queue, state)
+			if err != nil {
+				return nil, err
+			}
+			later = append(later, tasks...)
+		}
+	}
+	sort.SliceStable(later, func(i, j int) bool { return later[i].NextProcessAt.Before(later[j].NextProcessAt) })
+
+	rooms := []*WebhookIncomingMessageRequest{}
+	for _, task := range append(ordered, later...) {
+		if task.Type != TypeChatAssignAgent {
+			continue
+		}
+
+		var wimr WebhookIncomingMessageRequest
+		if err := json.Unmarshal(task.Payload, &wimr); err != nil {
+			continue
+		}
+		rooms = append(rooms, &wimr)
+	}
+
+	return rooms, nil
+}
+
+// SendWaitingMessages sends the waiting message to every room that has not
+// heard from us for queue_messages.interval.
+func (s *Service) SendWaitingMessages(ctx context.Context) error {
+	qm := s.conf().QueueMessages
+	if !qm.Enabled || qm.Waiting == "" {
+		return nil
+	}
+
+	rooms, err := s.waitingRooms()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, wimr := range rooms {
+		_, last, err := s.Rooms.QueueMessages(ctx, wimr.RoomID, wimr.LatestService.ID)
+		if err != nil {
+			return err
+		}
+		if last.IsZero() {
+			last, err = s.Rooms.EnqueuedAt(ctx, wimr.RoomID)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		if now.Sub(last) < qm.Interval {
+			continue
+		}
+
+		if _, err := s.sendQueueMessage(ctx, wimr, "waiting", qm.Waiting, i+1); err != nil {
+			log.Printf("Error sending waiting message to room %s: %v", wimr.RoomID, err)
+		}
+	}
+
+	return nil
+}
+
+// InitQueueMessages sends the waiting messages of every tenant until ctx is
+// done.
+func (ts Tenants) InitQueueMessages(ctx context.Context) {
+	ticker := time.NewTicker(queueMessageTick)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				for _, s := range ts {
+					if err := s.SendWaitingMessages(ctx); err != nil {
+						log.Printf("Waiting messages of tenant %q failed: %v", s.Tenant, err)
+					}
+				}
+			case <-ctx.Done():
+				log.Println("Stopping queue messages")
+				return
+			}
+		}
+	}()
+}
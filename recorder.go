@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RecordedWebhook is one line of a recording. Bodies that are not JSON are
+// kept as a JSON string and marked with Text.
+type RecordedWebhook struct {
+	Time   time.Time       `json:"time"`
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Header http.Header     `json:"header"`
+	Body   json.RawMessage `json:"body"`
+	Text   bool            `json:"text,omitempty"`
+}
+
+// body returns the body as it was received.
+func (rw *RecordedWebhook) body() ([]byte, error) {
+	if !rw.Text {
+		return rw.Body, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(rw.Body, &s); err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// Recorder appends every request it sees to a JSONL file.
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	// Recordings hold customer data
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording %s: %w", path, err)
+	}
+
+	return &Recorder{file: file}, nil
+}
+
+// Middleware records the request before passing it on. A request that
+// cannot be recorded is still served.
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if err := rec.Record(r, body); err != nil {
+			log.Printf("Failed to record webhook %s: %v", r.URL.Path, err)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rec *Recorder) Record(r *http.Request, body []byte) error {
+	rw := RecordedWebhook{
+		Time:   time.Now(),
+		Method: r.Method,
+		Path:   r.URL.RequestURI(),
+		Header: r.Header.Clone(),
+		Body:   body,
+	}
+
+	if !json.Valid(body) {
+		text, err := json.Marshal(string(body))
+		if err != nil {
+			return err
+		}
+		rw.Body = text
+		rw.Text = true
+	}
+
+	line, err := json.Marshal(rw)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	_, err = rec.file.Write(line)
+	return err
+}
+
+func (rec *Recorder) Close() error {
+	return rec.file.Close()
+}
+
+// replayHeaderSkip are the headers the http client sets itself
+var replayHeaderSkip = map[string]struct{}{
+	"Content-Length":  {},
+	"Host":            {},
+	"Connection":      {},
+	"Accept-Encoding": {},
+}
+
+// Replay sends the recording at rc.Path to rc.Target, waiting between the
+// webhooks as rc.Pacing says.
+func Replay(rc replayConfig) error {
+	file, err := os.Open(rc.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	sent, failed := 0, 0
+	statuses := map[int]int{}
+	start := time.Now()
+
+	var prev time.Time
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var rw RecordedWebhook
+		if err := json.Unmarshal(scanner.Bytes(), &rw); err != nil {
+			log.Printf("Skipping line %d: %v", line, err)
+			failed++
+			continue
+		}
+
+		if !prev.IsZero() {
+			time.Sleep(replayGap(rc, rw.Time.Sub(prev)))
+		}
+		prev = rw.Time
+
+		status, err := replayWebhook(client, rc.Target, &rw)
+		if err != nil {
+			log.Printf("Failed to replay line %d %s: %v", line, rw.Path, err)
+			failed++
+			continue
+		}
+
+		sent++
+		statuses[status]++
+		log.Printf("Replayed line %d %s %s: %d", line, rw.Method, rw.Path, status)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	fmt.Printf("Replayed %d webhooks in %s, %d failed\n", sent, time.Since(start).Round(time.Millisecond), failed)
+	for _, code := range codes {
+		fmt.Printf("  %d: %d\n", code, statuses[code])
+	}
+
+	return nil
+}
+
+func replayGap(rc replayConfig, recorded time.Duration) time.Duration {
+	switch rc.Pacing {
+	case "fixed":
+		return rc.Interval
+	case "accelerated":
+		recorded = time.Duration(float64(recorded) / rc.Speed)
+	}
+
+	if recorded < 0 {
+		return 0
+	}
+	return recorded
+}
+
+func replayWebhook(client *http.Client, target string, rw *RecordedWebhook) (int, error) {
+	body, err := rw.body()
+	if err != nil {
+		return 0, err
+	}
+
+	method := rw.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	req, err := http.NewRequest(method, target+rw.Path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	for key, values := range rw.Header {
+		if _, ok := replayHeaderSkip[http.CanonicalHeaderKey(key)]; ok {
+			continue
+		}
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	return res.StatusCode, nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RecoveryReport is what a sync with Qiscus found and changed.
+type RecoveryReport struct {
+	Ongoing int `json:"ongoing"`
+	// Mapped rooms got room:<id>:agent, rooms served only by people we do
+	// not know as agents are not mapped
+	Mapped int `json:"mapped"`
+	// Forgotten rooms were mapped but are no longer ongoing in Qiscus, they
+	// were resolved while we did not listen
+	Forgotten     int `json:"forgotten"`
+	ChatsCreated  int `json:"chats_created"`
+	Unserved      int `json:"unserved"`
+	Enqueued      int `json:"enqueued"`
+	Parked        int `json:"parked"`
+	AlreadyQueued int `json:"already_queued"`
+	// AlreadyKnown unserved rooms have a chat already, they were queued
+	// before and ran out of attempts
+	AlreadyKnown   int            `json:"already_known"`
+	CustomerCounts map[string]int `json:"customer_counts"`
+}
+
+// RecoverFromQiscus brings our state in line with Qiscus after webhooks
+// were missed or Redis was flushed. The ongoing rooms rebuild who serves
+// each room and the customer counts, their missing chats are inserted,
+// mapped rooms that are no longer ongoing are forgotten, and the unserved
+// rooms nobody queued are queued oldest first.
+//
+// The counts are set from what Qiscus lists, assignments made while the
+// sync runs can be lost, so on demand it is best run with the queues paused.
+func (s *Service) RecoverFromQiscus(ctx context.Context) (*RecoveryReport, error) {
+	report := &RecoveryReport{CustomerCounts: map[string]int{}}
+
+	if err := s.CacheAgentStatus(ctx); err != nil {
+		return nil, fmt.Errorf("Error caching agents: %w", err)
+	}
+
+	agentIDs, err := s.Agents.AgentIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range agentIDs {
+		report.CustomerCounts[id] = 0
+	}
+
+	// Taken before the listing, a room assigned while it runs is not in it
+	mapped, err := s.roomMappings(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing mapped rooms: %w", err)
+	}
+
+	ongoing, err := s.Qiscus.ListRooms(ctx, RoomsServed)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing ongoing rooms: %w", err)
+	}
+	report.Ongoing = len(ongoing)
+
+	for _, cr := range ongoing {
+		delete(mapped, cr.RoomID)
+		if err := s.recoverOngoingRoom(ctx, &cr, report); err != nil {
+			return report, fmt.Errorf("Error recovering room %s: %w", cr.RoomID, err)
+		}
+	}
+
+	for roomID, m := range mapped {
+		if err := s.forgetResolvedRoom(ctx, roomID, m, report); err != nil {
+			return report, fmt.Errorf("Error forgetting room %s: %w", roomID, err)
+		}
+	}
+
+	for id, count := range report.CustomerCounts {
+		if err := s.Agents.SetCustomerCount(ctx, id, count); err != nil {
+			return report, fmt.Errorf("Error setting customer count of agent %s: %w", id, err)
+		}
+		s.PublishCustomerCount(ctx, id, count)
+	}
+
+	unserved, err := s.Qiscus.ListRooms(ctx, RoomsUnserved)
+	if err != nil {
+		return report, fmt.Errorf("Error listing unserved rooms: %w", err)
+	}
+	report.Unserved = len(unserved)
+
+	if err := s.recoverUnservedRooms(ctx, unserved, report); err != nil {
+		return report, err
+	}
+
+	log.Printf("Recovered from Qiscus: %d ongoing rooms, %d chats created, %d resolved rooms forgotten, %d of %d unserved rooms enqueued, %d parked",
+		report.Ongoing, report.ChatsCreated, report.Forgotten, report.Enqueued, report.Unserved, report.Parked)
+
+	return report, nil
+}
+
+// roomMapping is who served a room and in which session when the sync
+// started.
+type roomMapping struct {
+	agentID   string
+	serviceID int
+}
+
+func (s *Service) roomMappings(ctx context.Context) (map[string]roomMapping, error) {
+	roomIDs, err := s.Agents.MappedRoomIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mapped := make(map[string]roomMapping, len(roomIDs))
+	for _, roomID := range roomIDs {
+		m, err := s.roomMapping(ctx, roomID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		mapped[roomID] = m
+	}
+
+	return mapped, nil
+}
+
+func (s *Service) roomMapping(ctx context.Context, roomID string) (roomMapping, error) {
+	agentID, err := s.Agents.RoomAgent(ctx, roomID)
+	if err != nil {
+		return roomMapping{}, err
+	}
+
+	serviceID, err := s.Agents.RoomService(ctx, roomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return roomMapping{}, err
+	}
+
+	return roomMapping{agentID: agentID, serviceID: serviceID}, nil
+}
+
+// forgetResolvedRoom drops who serves a room Qiscus no longer lists as
+// ongoing, and its idle chain, so the idle checks do not resolve and
+// release it again. A room assigned again since the sync started is kept.
+func (s *Service) forgetResolvedRoom(ctx context.Context, roomID string, before roomMapping, report *RecoveryReport) error {
+	now, err := s.roomMapping(ctx, roomID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if now != before {
+		return nil
+	}
+
+	if err := s.Agents.ForgetRoom(ctx, roomID); err != nil {
+		return err
+	}
+	if err := s.Rooms.ClearActivity(ctx, roomID); err != nil {
+		return err
+	}
+	report.Forgotten++
+
+	log.Printf("Room %s of agent %s is no longer ongoing in Qiscus, forgotten", roomID, before.agentID)
+	return nil
+}
+
+// recoverOngoingRoom counts the agents of the room and maps it to the first
+// one we know. A session we never saw gets its chat and an assignment by
+// the recovery.
+func (s *Service) recoverOngoingRoom(ctx context.Context, cr *CustomerRoom, report *RecoveryReport) error {
+	roomAgentID := ""
+	for _, a := range cr.Agents {
+		id := strconv.Itoa(a.ID)
+		if _, ok := report.CustomerCounts[id]; !ok {
+			continue
+		}
+
+		report.CustomerCounts[id]++
+		if roomAgentID == "" {
+			roomAgentID = id
+		}
+	}
+
+	if roomAgentID != "" {
+		if err := s.Agents.SetRoomAgent(ctx, cr.RoomID, cr.ServiceID, roomAgentID); err != nil {
+			return err
+		}
+		report.Mapped++
+	}
+
+	if len(cr.Agents) == 0 {
+		return nil
+	}
+
+	tx, err := s.Chats.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	exists, err := tx.IsChatSessionExists(ctx, cr.RoomID, cr.ServiceID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	wimr := cr.webhookRequest(s.conf().QiscusConfig.AppID)
+	if err := tx.CreateChat(ctx, wimr); err != nil {
+		return err
+	}
+
+	err = tx.CreateAssignment(ctx, &Assignment{
+		RoomID:    cr.RoomID,
+		ServiceID: cr.ServiceID,
+		AgentID:   cr.Agents[0].ID,
+		Kind:      AssignmentKindAssign,
+		Reason:    "Served in Qiscus before the sync",
+		Actor:     "recovery",
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.UpdateChat(ctx, wimr); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	report.ChatsCreated++
+
+	if err := s.StartIdleTracking(ctx, cr.RoomID); err != nil {
+		log.Printf("Error starting idle tracking of room %s: %v", cr.RoomID, err)
+	}
+
+	return nil
+}
+
+// recoverUnservedRooms queues the unserved rooms in the order they were
+// created, skipping the ones that wait in a queue, are parked or already
+// have a chat.
+func (s *Service) recoverUnservedRooms(ctx context.Context, rooms []CustomerRoom, report *RecoveryReport) error {
+	waiting, err := s.waitingRooms()
+	if err != nil {
+		return fmt.Errorf("Error listing queued rooms: %w", err)
+	}
+
+	queued := make(map[string]struct{}, len(waiting))
+	for _, wimr := range waiting {
+		queued[fmt.Sprintf("%s:%d", wimr.RoomID, wimr.LatestService.ID)] = struct{}{}
+	}
+
+	sort.SliceStable(rooms, func(i, j int) bool { return rooms[i].CreatedAt.Before(rooms[j].CreatedAt) })
+
+	now := time.Now()
+	for _, cr := range rooms {
+		if _, ok := queued[fmt.Sprintf("%s:%d", cr.RoomID, cr.ServiceID)]; ok {
+			report.AlreadyQueued++
+			continue
+		}
+
+		parked, err := s.Rooms.ParkedRoom(ctx, cr.RoomID)
+		if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrMalformed) {
+			return err
+		}
+		if parked != nil && parked.LatestService.ID == cr.ServiceID {
+			report.AlreadyQueued++
+			continue
+		}
+
+		exists, err := s.Chats.IsChatSessionExists(ctx, cr.RoomID, cr.ServiceID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			report.AlreadyKnown++
+			continue
+		}
+
+		wimr := cr.webhookRequest(s.conf().QiscusConfig.AppID)
+		if !s.IsChannelOpen(wimr.Source, now) {
+			if err := s.ParkRoom(ctx, wimr); err != nil {
+				return fmt.Errorf("Error parking room %s: %w", cr.RoomID, err)
+			}
+			report.Parked++
+			continue
+		}
+
+		if err := s.EnqueueChatAssignAgent(ctx, wimr); err != nil {
+			return fmt.Errorf("Error enqueueing room %s: %w", cr.RoomID, err)
+		}
+		report.Enqueued++
+		log.Printf("Room %s created at %s recovered into the queue", cr.RoomID, cr.CreatedAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// webhookRequest is the allocate webhook Qiscus would have sent for the
+// room's current session.
+func (cr *CustomerRoom) webhookRequest(appID string) *WebhookIncomingMessageRequest {
+	var wimr WebhookIncomingMessageRequest
+	wimr.AppID = appID
+	wimr.Source = cr.Source
+	wimr.Name = cr.Name
+	wimr.Email = cr.UserID
+	wimr.AvatarURL = cr.UserAvatarURL
+	wimr.RoomID = cr.RoomID
+	wimr.LatestService.ID = cr.ServiceID
+	wimr.LatestService.RoomID = cr.RoomID
+	wimr.LatestService.LastCommentID = cr.LastCommentID
+	if !cr.CreatedAt.IsZero() {
+		wimr.LatestService.CreatedAt = cr.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	if len(cr.Extras) > 0 {
+		if extras, err := json.Marshal(cr.Extras); err == nil {
+			wimr.Extras = string(extras)
+		}
+	}
+
+	return &wimr
+}
+
+func (s *Service) HandleRecoverySync(w http.ResponseWriter, r *http.Request) {
+	// A sync cut short leaves the counts half rebuilt
+	ctx := context.WithoutCancel(r.Context())
+
+	report, err := s.RecoverFromQiscus(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to sync with Qiscus: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
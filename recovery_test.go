@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestForgetResolvedRooms(t *testing.T) {
+	ctx := context.Background()
+	s, agents, rooms, _ := newTestService(t)
+
+	agents.SetRoomAgent(ctx, "resolved", 10, "1")
+	agents.SetRoomAgent(ctx, "reassigned", 20, "1")
+
+	mapped, err := s.roomMappings(ctx)
+	if err != nil {
+		t.Fatalf("roomMappings: %v", err)
+	}
+	if len(mapped) != 2 {
+		t.Fatalf("mapped rooms = %v, want 2", mapped)
+	}
+
+	// A new session of the room is assigned while the sync runs
+	agents.SetRoomAgent(ctx, "reassigned", 21, "2")
+
+	report := &RecoveryReport{}
+	for roomID, m := range mapped {
+		if err := s.forgetResolvedRoom(ctx, roomID, m, report); err != nil {
+			t.Fatalf("forgetResolvedRoom %s: %v", roomID, err)
+		}
+	}
+
+	if report.Forgotten != 1 {
+		t.Errorf("forgotten = %d, want 1", report.Forgotten)
+	}
+	if _, err := agents.RoomAgent(ctx, "resolved"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("resolved room still mapped: err = %v", err)
+	}
+	if len(rooms.cleared) != 1 || rooms.cleared[0] != "resolved" {
+		t.Errorf("activity cleared for %v, want [resolved]", rooms.cleared)
+	}
+	if id, err := agents.RoomAgent(ctx, "reassigned"); err != nil || id != "2" {
+		t.Errorf("agent of the reassigned room = %q, %v, want 2", id, err)
+	}
+}
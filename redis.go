@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -20,185 +22,560 @@ func NewRedisConfig(redisUrl string) *RedisConfig {
 	}
 }
 
-func getToken(ctx context.Context) (string, error) {
-	cachedToken, err := rdb.Get(ctx, CACHE_TOKEN_KEY).Result()
+const (
+	PARKED_ROOMS_KEY    = "rooms:parked"
+	DRAINING_AGENTS_KEY = "agents:draining"
+	EVENTS_CHANNEL      = "events"
+)
+
+// roomActivityTTL bounds how long activity keys of forgotten rooms live
+const roomActivityTTL = 7 * 24 * time.Hour
+
+// redisStore keeps the agent and room state, the events and the Qiscus
+// token of one tenant in Redis. Keys of every tenant but the default one
+// are prefixed with its name.
+type redisStore struct {
+	rdb    *redis.Client
+	tenant string
+}
+
+func newRedisStore(rdb *redis.Client, tenant string) *redisStore {
+	return &redisStore{rdb: rdb, tenant: tenant}
+}
+
+func (s *redisStore) key(format string, args ...any) string {
+	k := fmt.Sprintf(format, args...)
+	if s.tenant == "" {
+		return k
+	}
+
+	return "tenant:" + s.tenant + ":" + k
+}
+
+func notFound(err error) error {
+	if err == redis.Nil {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+func (s *redisStore) getTime(ctx context.Context, key string) (time.Time, error) {
+	ms, err := s.rdb.Get(ctx, key).Int64()
+	if err != nil {
+		return time.Time{}, notFound(err)
+	}
+
+	return time.UnixMilli(ms), nil
+}
+
+func (s *redisStore) AgentIDs(ctx context.Context) ([]string, error) {
+	ids, err := s.rdb.SMembers(ctx, s.key("agents:ids")).Result()
+	if err != nil {
+		return nil, fmt.Errorf("SMembers error: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (s *redisStore) IsAgent(ctx context.Context, agentID string) (bool, error) {
+	return s.rdb.SIsMember(ctx, s.key("agents:ids"), agentID).Result()
+}
+
+func (s *redisStore) AddAgent(ctx context.Context, agentID string, emails []string) error {
+	err := s.rdb.SAdd(ctx, s.key("agents:ids"), agentID).Err()
+	if err != nil {
+		return fmt.Errorf("SAdd error: %w", err)
+	}
+
+	err = s.rdb.Set(ctx, s.key("agent:%s:emails", agentID), strings.Join(emails, ","), 0).Err()
+	if err != nil {
+		return fmt.Errorf("Set emails error: %w", err)
+	}
+
+	return nil
+}
+
+func (s *redisStore) ForgetAgent(ctx context.Context, agentID string) error {
+	s.rdb.Del(ctx, s.key("agent:%s:is_online", agentID))
+	return s.rdb.SRem(ctx, s.key("agents:ids"), agentID).Err()
+}
+
+func (s *redisStore) AgentEmails(ctx context.Context, agentID string) ([]string, error) {
+	emails, err := s.rdb.Get(ctx, s.key("agent:%s:emails", agentID)).Result()
 	if err != nil && err != redis.Nil {
-		return "", err
+		return nil, err
 	}
-	if cachedToken != "" {
-		return cachedToken, nil
+
+	var list []string
+	for _, email := range strings.Split(emails, ",") {
+		if email != "" {
+			list = append(list, email)
+		}
 	}
 
-	login := NewLoginRequest("wefeho7425@linacit.com", "RTwEe111")
-	tokenResponse, err := login.Login()
+	return list, nil
+}
+
+func (s *redisStore) SetOnline(ctx context.Context, agentID string, online bool) (bool, error) {
+	// go-redis stores booleans as "1" and "0"
+	previous, err := s.rdb.SetArgs(ctx, s.key("agent:%s:is_online", agentID), online, redis.SetArgs{Get: true}).Result()
+	if err != nil && err != redis.Nil {
+		return false, fmt.Errorf("Set is_online error: %w", err)
+	}
+
+	return previous == "1", nil
+}
+
+func (s *redisStore) IsOnline(ctx context.Context, agentID string) (bool, error) {
+	isOnline, err := s.rdb.Get(ctx, s.key("agent:%s:is_online", agentID)).Bool()
+	if err != nil && err != redis.Nil {
+		return false, fmt.Errorf("Get is_online error: %w", err)
+	}
+
+	return isOnline, nil
+}
+
+func (s *redisStore) CustomerCount(ctx context.Context, agentID string) (int, error) {
+	count, err := s.rdb.Get(ctx, s.key("agent:%s:customer_count", agentID)).Int()
 	if err != nil {
-		return "", err
+		return 0, notFound(err)
 	}
 
-	token := tokenResponse.Data.User.AuthenticationToken
+	return count, nil
+}
+
+func (s *redisStore) SetCustomerCount(ctx context.Context, agentID string, count int) error {
+	return s.rdb.Set(ctx, s.key("agent:%s:customer_count", agentID), count, 0).Err()
+}
 
-	err = rdb.Set(ctx, CACHE_TOKEN_KEY, token, 3600).Err()
+func (s *redisStore) InitCustomerCount(ctx context.Context, agentID string) error {
+	err := s.rdb.SetNX(ctx, s.key("agent:%s:customer_count", agentID), -1, 0).Err()
 	if err != nil {
-		return "", err
+		return fmt.Errorf("Set customer_count error: %w", err)
 	}
 
-	return token, nil
+	return nil
 }
 
-type CachedAgent struct {
-	ID                   string
-	CurrentCustomerCount int
+func (s *redisStore) RoomAgent(ctx context.Context, roomID string) (string, error) {
+	agentID, err := s.rdb.Get(ctx, s.key("room:%s:agent", roomID)).Result()
+	if err != nil {
+		return "", notFound(err)
+	}
+
+	return agentID, nil
+}
+
+func (s *redisStore) RoomService(ctx context.Context, roomID string) (int, error) {
+	serviceID, err := s.rdb.Get(ctx, s.key("room:%s:service", roomID)).Int()
+	if err != nil {
+		return 0, notFound(err)
+	}
+
+	return serviceID, nil
 }
 
-func GetCachedAvailableAgents(ctx context.Context) ([]CachedAgent, error) {
-	var availableAgents []CachedAgent
+func (s *redisStore) AssignRoom(ctx context.Context, roomID string, serviceID int, agentID string) (int, error) {
+	count, err := s.rdb.Incr(ctx, s.key("agent:%s:customer_count", agentID)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("Incr customer_count error: %w", err)
+	}
 
-	agentIDs, err := rdb.SMembers(ctx, "agent:ids").Result()
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.key("room:%s:agent", roomID), agentID, 0)
+		pipe.Set(ctx, s.key("room:%s:service", roomID), serviceID, 0)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error getting agent IDs: %w", err)
+		return 0, fmt.Errorf("Set room agent error: %w", err)
 	}
 
-	for _, id := range agentIDs {
-		key := fmt.Sprintf("agent:%s:customer_count", id)
-		countStr, err := rdb.Get(ctx, key).Result()
-		if err != nil {
-			if err == redis.Nil {
-				availableAgents = append(availableAgents, CachedAgent{
-					ID: id, CurrentCustomerCount: 0,
-				})
-			} else {
-				return nil, fmt.Errorf("error getting customer count for %s: %w", id, err)
-			}
+	return int(count), nil
+}
+
+func (s *redisStore) SetRoomAgent(ctx context.Context, roomID string, serviceID int, agentID string) error {
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.key("room:%s:agent", roomID), agentID, 0)
+		pipe.Set(ctx, s.key("room:%s:service", roomID), serviceID, 0)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) MappedRoomIDs(ctx context.Context) ([]string, error) {
+	prefix, suffix := s.key("room:"), ":agent"
+
+	var roomIDs []string
+	iter := s.rdb.Scan(ctx, 0, s.key("room:*:agent"), 100).Iterator()
+	for iter.Next(ctx) {
+		roomID, ok := strings.CutPrefix(iter.Val(), prefix)
+		if !ok {
 			continue
 		}
+		roomIDs = append(roomIDs, strings.TrimSuffix(roomID, suffix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("Scan room agents error: %w", err)
+	}
+
+	return roomIDs, nil
+}
+
+func (s *redisStore) ForgetRoom(ctx context.Context, roomID string) error {
+	return s.rdb.Del(ctx, s.key("room:%s:agent", roomID), s.key("room:%s:service", roomID)).Err()
+}
+
+func (s *redisStore) ReleaseRoom(ctx context.Context, roomID string, serviceID int, agentID string) (int, error) {
+	count, err := s.rdb.Decr(ctx, s.key("agent:%s:customer_count", agentID)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("Decr customer_count error: %w", err)
+	}
 
-		count, _ := strconv.Atoi(countStr)
-		if count < int(cfg.WebhookConfig.MaxCurrentCustomer) {
-			availableAgents = append(availableAgents, CachedAgent{
-				ID: id, CurrentCustomerCount: count,
-			})
+	// Only the room's own agent is forgotten, not one released as fallback
+	// or for an earlier session
+	roomAgentKey := s.key("room:%s:agent", roomID)
+	roomServiceKey := s.key("room:%s:service", roomID)
+	if current, err := s.rdb.Get(ctx, roomAgentKey).Result(); err == nil && current == agentID {
+		currentService, err := s.rdb.Get(ctx, roomServiceKey).Int()
+		if serviceID == 0 || err != nil || currentService == serviceID {
+			s.rdb.Del(ctx, roomAgentKey, roomServiceKey)
 		}
 	}
 
-	return availableAgents, nil
+	return int(count), nil
 }
 
-func GetAvailableAgentWithCustomerCount(ctx context.Context, roomID string, maxCustomerCount int) (agentID string, err error) {
-	const maxRetryDuration = 10 * time.Minute
-	const retryInterval = 10 * time.Second
+// MoveRoom runs in a single MULTI so both counters always change together.
+func (s *redisStore) MoveRoom(ctx context.Context, roomID, fromAgentID, toAgentID string) (int, int, error) {
+	var fromCount, toCount *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		fromCount = pipe.Decr(ctx, s.key("agent:%s:customer_count", fromAgentID))
+		toCount = pipe.Incr(ctx, s.key("agent:%s:customer_count", toAgentID))
+		pipe.Set(ctx, s.key("room:%s:agent", roomID), toAgentID, 0)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("Move room agent error: %w", err)
+	}
 
-	start := time.Now()
+	return int(fromCount.Val()), int(toCount.Val()), nil
+}
 
-	for time.Since(start) < maxRetryDuration {
-		agentIDs, err := rdb.SMembers(ctx, "agents:ids").Result()
-		if err != nil {
-			log.Printf("Error getting agents %v", err)
-			return agentID, fmt.Errorf("SMembers error: %w", err)
-		}
+func (s *redisStore) DrainingAgents(ctx context.Context) (map[string]struct{}, error) {
+	ids, err := s.rdb.SMembers(ctx, s.key(DRAINING_AGENTS_KEY)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("SMembers draining error: %w", err)
+	}
 
-		foundUnknownCustomerKey := false
-		agentCustomerCount := 0
-		for _, id := range agentIDs {
-			isOnlineKey := fmt.Sprintf("agent:%s:is_online", id)
-			customerCountKey := fmt.Sprintf("agent:%s:customer_count", id)
-
-			isOnline, err := rdb.Get(ctx, isOnlineKey).Bool()
-			if err != nil {
-				if err != redis.Nil {
-					log.Printf("Error getting online status %s err: %v", isOnlineKey, err)
-					return agentID, fmt.Errorf("Could not get is_online")
-				}
-			}
+	draining := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		draining[id] = struct{}{}
+	}
 
-			if !isOnline {
-				continue
-			}
+	return draining, nil
+}
 
-			customerCount, err := rdb.Get(ctx, customerCountKey).Int()
-			if err != nil {
-				if err != redis.Nil {
-					foundUnknownCustomerKey = true
-					continue
-				}
-				log.Printf("Error getting current customer count %s err: %v", customerCountKey, err)
-				return agentID, fmt.Errorf("Could not get customer count")
-			}
+func (s *redisStore) SetDraining(ctx context.Context, agentID string, draining bool) error {
+	if draining {
+		return s.rdb.SAdd(ctx, s.key(DRAINING_AGENTS_KEY), agentID).Err()
+	}
 
-			if customerCount == -1 {
-				foundUnknownCustomerKey = true
-				continue
-			}
+	return s.rdb.SRem(ctx, s.key(DRAINING_AGENTS_KEY), agentID).Err()
+}
 
-			if customerCount < maxCustomerCount {
-				if agentID == "" {
-					agentCustomerCount = customerCount
-					agentID = id
-					continue
-				}
-				if customerCount <= agentCustomerCount {
-					agentCustomerCount = customerCount
-					agentID = id
-				}
-			}
-		}
+func (s *redisStore) IsDraining(ctx context.Context, agentID string) (bool, error) {
+	return s.rdb.SIsMember(ctx, s.key(DRAINING_AGENTS_KEY), agentID).Result()
+}
 
-		if agentID != "" {
-			log.Printf("Found agent %s for room %s with current customer count %d", agentID, roomID, agentCustomerCount)
-			return agentID, nil
-		}
+func (s *redisStore) SetEnqueuedAt(ctx context.Context, roomID string, t time.Time) error {
+	return s.rdb.Set(ctx, s.key("room:%s:enqueued_at", roomID), t.UnixMilli(), 24*time.Hour).Err()
+}
 
-		if foundUnknownCustomerKey {
-			agentID, customerCount, err := GetAndCacheAvailableAgentWithCustomerCount(ctx, roomID, maxCustomerCount)
-			if err != nil {
-				fmt.Println("Can not call available agent")
-			}
-			if agentID != "" {
-				log.Printf("Found agent id %s for room %s with customer count %d from source", agentID, roomID, customerCount)
-				return agentID, nil
-			}
-		}
+func (s *redisStore) EnqueuedAt(ctx context.Context, roomID string) (time.Time, error) {
+	return s.getTime(ctx, s.key("room:%s:enqueued_at", roomID))
+}
 
-		log.Printf("Retrying allocate agent for room %s", roomID)
-		time.Sleep(retryInterval)
+func (s *redisStore) SetArrivedAt(ctx context.Context, roomID string, t time.Time) error {
+	return s.rdb.Set(ctx, s.key("room:%s:arrived_at", roomID), t.UnixMilli(), 24*time.Hour).Err()
+}
+
+func (s *redisStore) ArrivedAt(ctx context.Context, roomID string) (time.Time, error) {
+	return s.getTime(ctx, s.key("room:%s:arrived_at", roomID))
+}
+
+func (s *redisStore) SetLastActivity(ctx context.Context, roomID string, t time.Time) error {
+	err := s.rdb.Set(ctx, s.key("room:%s:last_activity", roomID), t.UnixMilli(), roomActivityTTL).Err()
+	if err != nil {
+		return fmt.Errorf("Set last_activity error: %w", err)
+	}
+
+	return nil
+}
+
+func (s *redisStore) LastActivity(ctx context.Context, roomID string) (time.Time, error) {
+	return s.getTime(ctx, s.key("room:%s:last_activity", roomID))
+}
+
+func (s *redisStore) SetLastCommentID(ctx context.Context, roomID, commentID string) error {
+	err := s.rdb.Set(ctx, s.key("room:%s:last_comment_id", roomID), commentID, roomActivityTTL).Err()
+	if err != nil {
+		return fmt.Errorf("Set last_comment_id error: %w", err)
 	}
-	return agentID, fmt.Errorf("Can not find any available agent")
+
+	return nil
 }
 
-func GetAndCacheAvailableAgentWithCustomerCount(ctx context.Context, roomID string, maxCustomerCount int) (agentID string, agentCustomerCount int, err error) {
-	availableAgents, err := GetAvailableAgent(roomID)
+func (s *redisStore) LastCommentID(ctx context.Context, roomID string) (string, error) {
+	commentID, err := s.rdb.Get(ctx, s.key("room:%s:last_comment_id", roomID)).Result()
 	if err != nil {
-		log.Printf("Error getting available agents: %v", err)
-		return agentID, agentCustomerCount, err
+		return "", notFound(err)
 	}
 
-	for _, agent := range availableAgents.Data.Agents {
-		isOnlineKey := fmt.Sprintf("agent:%d:is_online", agent.ID)
-		customerCountKey := fmt.Sprintf("agent:%d:customer_count", agent.ID)
+	return commentID, nil
+}
 
-		err = rdb.Set(ctx, isOnlineKey, true, 0).Err()
-		if err != nil {
-			log.Printf("Error set %s err: %v", isOnlineKey, err)
-			return agentID, agentCustomerCount, err
-		}
+func (s *redisStore) SetIdleChain(ctx context.Context, roomID, chain string) error {
+	err := s.rdb.Set(ctx, s.key("room:%s:idle_chain", roomID), chain, roomActivityTTL).Err()
+	if err != nil {
+		return fmt.Errorf("Set idle_chain error: %w", err)
+	}
+
+	return nil
+}
+
+func (s *redisStore) IdleChain(ctx context.Context, roomID string) (string, error) {
+	chain, err := s.rdb.Get(ctx, s.key("room:%s:idle_chain", roomID)).Result()
+	if err != nil {
+		return "", notFound(err)
+	}
 
-		err = rdb.Set(ctx, customerCountKey, agent.CurrentCustomerCount, 0).Err()
-		if err != nil {
-			log.Printf("Error set %s err: %v", customerCountKey, err)
-			return agentID, agentCustomerCount, err
+	return chain, nil
+}
+
+func (s *redisStore) ClearActivity(ctx context.Context, roomID string) error {
+	return s.rdb.Del(ctx,
+		s.key("room:%s:idle_chain", roomID),
+		s.key("room:%s:last_activity", roomID),
+		s.key("room:%s:last_comment_id", roomID),
+	).Err()
+}
+
+func (s *redisStore) SetFirstResponse(ctx context.Context, roomID string, serviceID int, t time.Time) error {
+	return s.rdb.SetNX(ctx, s.key("room:%s:%d:first_response_at", roomID, serviceID), t.UnixMilli(), roomActivityTTL).Err()
+}
+
+func (s *redisStore) FirstResponseAt(ctx context.Context, roomID string, serviceID int) (time.Time, error) {
+	return s.getTime(ctx, s.key("room:%s:%d:first_response_at", roomID, serviceID))
+}
+
+func (s *redisStore) ClearFirstResponse(ctx context.Context, roomID string, serviceID int) error {
+	return s.rdb.Del(ctx, s.key("room:%s:%d:first_response_at", roomID, serviceID)).Err()
+}
+
+// Resolves are kept for a day, the estimated wait only looks at the last
+// queue_messages.window of them.
+func (s *redisStore) RecordResolve(ctx context.Context, roomID string, t time.Time) error {
+	key := s.key("resolves")
+	ms := t.UnixMilli()
+
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(ms), Member: fmt.Sprintf("%s:%d", roomID, ms)})
+		pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprintf("(%d", t.Add(-24*time.Hour).UnixMilli()))
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) ResolvesSince(ctx context.Context, since time.Time) (int, error) {
+	n, err := s.rdb.ZCount(ctx, s.key("resolves"), fmt.Sprintf("%d", since.UnixMilli()), "+inf").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+func (s *redisStore) QueueMessages(ctx context.Context, roomID string, serviceID int) (int, time.Time, error) {
+	values, err := s.rdb.HGetAll(ctx, s.key("room:%s:%d:queue_messages", roomID, serviceID)).Result()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	count, _ := strconv.Atoi(values["count"])
+	var last time.Time
+	if ms, err := strconv.ParseInt(values["last"], 10, 64); err == nil {
+		last = time.UnixMilli(ms)
+	}
+
+	return count, last, nil
+}
+
+func (s *redisStore) RecordQueueMessage(ctx context.Context, roomID string, serviceID int, t time.Time) error {
+	key := s.key("room:%s:%d:queue_messages", roomID, serviceID)
+
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, key, "count", 1)
+		pipe.HSet(ctx, key, "last", t.UnixMilli())
+		pipe.Expire(ctx, key, 24*time.Hour)
+		return nil
+	})
+	return err
+}
+
+// TakeQueueMessage counts one message in the minute of t.
+func (s *redisStore) TakeQueueMessage(ctx context.Context, t time.Time) (int, error) {
+	key := s.key("queue_messages:%d", t.Unix()/60)
+
+	var count *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, 2*time.Minute)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(count.Val()), nil
+}
+
+// The abandoned flag only has to outlive the assign task of the room.
+func (s *redisStore) SetAbandoned(ctx context.Context, roomID string, serviceID int) error {
+	return s.rdb.Set(ctx, s.key("room:%s:abandoned", roomID), serviceID, 24*time.Hour).Err()
+}
+
+func (s *redisStore) IsAbandoned(ctx context.Context, roomID string, serviceID int) (bool, error) {
+	abandoned, err := s.rdb.Get(ctx, s.key("room:%s:abandoned", roomID)).Int()
+	if err != nil {
+		if err == redis.Nil {
+			return false, nil
 		}
+		return false, err
+	}
 
-		if agent.CurrentCustomerCount < maxCustomerCount {
-			if agentID == "" {
-				agentCustomerCount = agent.CurrentCustomerCount
-				agentID = fmt.Sprintf("%d", agent.ID)
-				continue
-			}
-			if agent.CurrentCustomerCount <= agentCustomerCount {
-				agentCustomerCount = agent.CurrentCustomerCount
-				agentID = fmt.Sprintf("%d", agent.ID)
+	return serviceID == 0 || abandoned == 0 || abandoned == serviceID, nil
+}
+
+// ParkRoom keeps parked rooms in a sorted set scored by arrival so they are
+// released in FIFO order.
+func (s *redisStore) ParkRoom(ctx context.Context, wimr *WebhookIncomingMessageRequest, at time.Time) error {
+	payload, err := json.Marshal(wimr)
+	if err != nil {
+		return err
+	}
+
+	err = s.rdb.Set(ctx, s.key("room:%s:parked", wimr.RoomID), payload, 0).Err()
+	if err != nil {
+		return fmt.Errorf("Set parked room error: %w", err)
+	}
+
+	// Kept while the room is parked, a weekend is longer than the usual TTL
+	err = s.rdb.Set(ctx, s.key("room:%s:arrived_at", wimr.RoomID), at.UnixMilli(), 0).Err()
+	if err != nil {
+		return fmt.Errorf("Set arrived_at error: %w", err)
+	}
+
+	err = s.rdb.ZAddNX(ctx, s.key(PARKED_ROOMS_KEY), redis.Z{
+		Score:  float64(at.UnixMilli()),
+		Member: wimr.RoomID,
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("ZAdd parked room error: %w", err)
+	}
+
+	return nil
+}
+
+func (s *redisStore) ParkedRoomIDs(ctx context.Context) ([]string, error) {
+	roomIDs, err := s.rdb.ZRange(ctx, s.key(PARKED_ROOMS_KEY), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("ZRange parked rooms error: %w", err)
+	}
+
+	return roomIDs, nil
+}
+
+func (s *redisStore) ParkedRoom(ctx context.Context, roomID string) (*WebhookIncomingMessageRequest, error) {
+	payload, err := s.rdb.Get(ctx, s.key("room:%s:parked", roomID)).Bytes()
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	var wimr WebhookIncomingMessageRequest
+	if err := json.Unmarshal(payload, &wimr); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	return &wimr, nil
+}
+
+func (s *redisStore) UnparkRoom(ctx context.Context, roomID string) error {
+	s.rdb.ZRem(ctx, s.key(PARKED_ROOMS_KEY), roomID)
+	s.rdb.Expire(ctx, s.key("room:%s:arrived_at", roomID), 24*time.Hour)
+	return s.rdb.Del(ctx, s.key("room:%s:parked", roomID)).Err()
+}
+
+func (s *redisStore) Publish(ctx context.Context, ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	return s.rdb.Publish(ctx, s.key(EVENTS_CHANNEL), payload).Err()
+}
+
+func (s *redisStore) Subscribe(ctx context.Context) (<-chan Event, error) {
+	sub := s.rdb.Subscribe(ctx, s.key(EVENTS_CHANNEL))
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer sub.Close()
+
+		messages := sub.Channel()
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+
+				var ev Event
+				if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+					log.Printf("Skipping malformed event: %v", err)
+					continue
+				}
+
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
 			}
 		}
+	}()
+
+	return events, nil
+}
+
+// Token returns the cached Qiscus admin token of the account, ErrNotFound
+// once it expired.
+func (s *redisStore) Token(ctx context.Context, account string) (string, error) {
+	token, err := s.rdb.Get(ctx, s.key("%s:%s", CACHE_TOKEN_KEY, account)).Result()
+	if err != nil {
+		return "", notFound(err)
 	}
 
-	return agentID, agentCustomerCount, nil
+	return token, nil
+}
+
+func (s *redisStore) SetToken(ctx context.Context, account, token string, ttl time.Duration) error {
+	return s.rdb.Set(ctx, s.key("%s:%s", CACHE_TOKEN_KEY, account), token, ttl).Err()
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// configHolder keeps the config in effect, reloads swap it as a whole.
+type configHolder struct {
+	current atomic.Pointer[config]
+}
+
+func newConfigHolder(c *config) *configHolder {
+	h := &configHolder{}
+	h.current.Store(c)
+	return h
+}
+
+func (h *configHolder) Load() *config {
+	return h.current.Load()
+}
+
+// buildConfig loads defaults, then the environment, then the config file.
+// The result is only returned when its secrets resolve and it validates for
+// the mode.
+func buildConfig(fn, mode string) (*config, error) {
+	c := defaultConfig()
+	c.mode = mode
+	c.loadFromEnv()
+
+	if len(fn) > 0 {
+		err := loadConfigFromFile(fn, &c)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("Cannot load config file %s: %w", fn, err)
+			}
+			log.Printf("Config file %s not found, using defaults and environment", fn)
+		}
+	}
+
+	if err := c.resolveSecrets(); err != nil {
+		return nil, fmt.Errorf("Cannot load secrets: %w", err)
+	}
+
+	if err := c.buildTenants(); err != nil {
+		return nil, fmt.Errorf("Invalid config:\n%w", err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config:\n%w", err)
+	}
+
+	return &c, nil
+}
+
+type configSection struct {
+	name   string
+	field  func(c *config) any
+	reload func(dst, src *config)
+}
+
+// reloadableSections are applied at runtime, everything else is read once
+// at startup and needs a restart.
+var reloadableSections = []configSection{
+	{
+		name:   "webhook.max_current_customer",
+		field:  func(c *config) any { return c.WebhookConfig.MaxCurrentCustomer },
+		reload: func(dst, src *config) { dst.WebhookConfig.MaxCurrentCustomer = src.WebhookConfig.MaxCurrentCustomer },
+	},
+	{
+		name:   "queue",
+		field:  func(c *config) any { return c.QueueConfig },
+		reload: func(dst, src *config) { dst.QueueConfig = src.QueueConfig },
+	},
+	{
+		name:   "business_hours",
+		field:  func(c *config) any { return c.BusinessHours },
+		reload: func(dst, src *config) { dst.BusinessHours = src.BusinessHours },
+	},
+	{
+		name:   "shifts",
+		field:  func(c *config) any { return c.Shifts },
+		reload: func(dst, src *config) { dst.Shifts = src.Shifts },
+	},
+	{
+		name:   "auto_resolve",
+		field:  func(c *config) any { return c.AutoResolve },
+		reload: func(dst, src *config) { dst.AutoResolve = src.AutoResolve },
+	},
+	{
+		name:   "sla",
+		field:  func(c *config) any { return c.SLA },
+		reload: func(dst, src *config) { dst.SLA = src.SLA },
+	},
+	{
+		name:   "allocation",
+		field:  func(c *config) any { return c.Allocation },
+		reload: func(dst, src *config) { dst.Allocation = src.Allocation },
+	},
+	{
+		name:   "qiscus",
+		field:  func(c *config) any { return c.QiscusConfig },
+		reload: func(dst, src *config) { dst.QiscusConfig = src.QiscusConfig },
+	},
+	{
+		name:  "tenants",
+		field: func(c *config) any { return c.Tenants },
+		reload: func(dst, src *config) {
+			// Every tenant has its own workers, adding or removing one needs a restart
+			if reflect.DeepEqual(dst.tenantNames(), src.tenantNames()) {
+				dst.Tenants = src.Tenants
+			}
+		},
+	},
+}
+
+var restartSections = []configSection{
+	{name: "listen", field: func(c *config) any { return c.Listen }},
+	{name: "db", field: func(c *config) any { return c.DBConfig }},
+	{name: "redis", field: func(c *config) any { return c.RedisConfig }},
+	{name: "webhook.base_url", field: func(c *config) any { return c.WebhookConfig.BaseUrl }},
+	{name: "admin", field: func(c *config) any { return c.Admin }},
+	{name: "fake_qiscus", field: func(c *config) any { return c.FakeQiscus }},
+	{name: "recorder", field: func(c *config) any { return c.Recorder }},
+	{name: "tenants (added or removed)", field: func(c *config) any { return c.tenantNames() }},
+}
+
+// Reload loads the config again and swaps in its reloadable sections. A
+// config that fails to load or validate is rejected as a whole and the
+// running one is kept.
+func (h *configHolder) Reload(fn string) error {
+	next, err := buildConfig(fn, h.Load().mode)
+	if err != nil {
+		return err
+	}
+
+	prev := h.Load()
+	merged := *prev
+
+	var changed []string
+	for _, s := range reloadableSections {
+		if !reflect.DeepEqual(s.field(prev), s.field(next)) {
+			s.reload(&merged, next)
+			changed = append(changed, s.name)
+		}
+	}
+
+	for _, s := range restartSections {
+		if !reflect.DeepEqual(s.field(prev), s.field(next)) {
+			log.Printf("Config reload: %s changed, restart to apply it", s.name)
+		}
+	}
+
+	if len(changed) == 0 {
+		log.Println("Config reload: nothing to apply")
+		return nil
+	}
+
+	// Tenants inherit from the top level, so they are rebuilt on the merge
+	if err := merged.buildTenants(); err != nil {
+		return err
+	}
+	if err := merged.validateTenants(); err != nil {
+		return fmt.Errorf("Invalid config:\n%w", err)
+	}
+
+	h.current.Store(&merged)
+	log.Printf("Config reload applied: %s", strings.Join(changed, ", "))
+
+	return nil
+}
+
+// Watch reloads the config on SIGHUP and whenever the config file is
+// modified, until ctx is done.
+func (h *configHolder) Watch(ctx context.Context, fn string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var lastMod time.Time
+	if fi, err := os.Stat(fn); err == nil {
+		lastMod = fi.ModTime()
+	}
+
+	reload := func(reason string) {
+		log.Printf("Reloading config (%s)", reason)
+		if err := h.Reload(fn); err != nil {
+			log.Printf("Config reload rejected: %v", err)
+		}
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reload("SIGHUP")
+			case <-ticker.C:
+				fi, err := os.Stat(fn)
+				if err != nil || fi.ModTime().Equal(lastMod) {
+					continue
+				}
+				lastMod = fi.ModTime()
+				reload(fn + " changed")
+			}
+		}
+	}()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+var (
+	// ErrNotFound is returned by the stores and repositories for missing
+	// keys and rows
+	ErrNotFound = errors.New("not found")
+	// ErrMalformed is returned for stored values that cannot be decoded
+	ErrMalformed = errors.New("malformed")
+)
+
+// Service serves one tenant. The handlers and task processors are its
+// methods and only reach the outside world through the dependencies below,
+// main wires the real ones.
+type Service struct {
+	// Tenant is empty for the default tenant
+	Tenant string
+
+	Agents AgentStore
+	Rooms  RoomStore
+	Chats  ChatRepository
+	Qiscus QiscusClient
+	Queue  TaskQueue
+	Events EventBus
+
+	config *configHolder
+}
+
+// conf returns the effective config of the tenant. Callers that read
+// several fields which must agree should keep the returned pointer instead
+// of calling conf again.
+func (s *Service) conf() *config {
+	return s.config.Load().tenant(s.Tenant)
+}
+
+// AgentStore caches the agents of the tenant with their availability and
+// load, and which agent serves which room.
+type AgentStore interface {
+	AgentIDs(ctx context.Context) ([]string, error)
+	IsAgent(ctx context.Context, agentID string) (bool, error)
+	// AddAgent remembers the agent and the addresses its messages come from
+	AddAgent(ctx context.Context, agentID string, emails []string) error
+	ForgetAgent(ctx context.Context, agentID string) error
+	AgentEmails(ctx context.Context, agentID string) ([]string, error)
+
+	// SetOnline returns whether the agent was online before
+	SetOnline(ctx context.Context, agentID string, online bool) (bool, error)
+	IsOnline(ctx context.Context, agentID string) (bool, error)
+
+	// CustomerCount returns ErrNotFound for agents without a count, -1
+	// means the count is not known yet
+	CustomerCount(ctx context.Context, agentID string) (int, error)
+	SetCustomerCount(ctx context.Context, agentID string, count int) error
+	// InitCustomerCount sets the count to -1 unless the agent has one
+	InitCustomerCount(ctx context.Context, agentID string) error
+
+	// RoomAgent returns ErrNotFound when no agent serves the room
+	RoomAgent(ctx context.Context, roomID string) (string, error)
+	// RoomService returns the service session the room's agent serves,
+	// ErrNotFound when no agent serves the room or the session is unknown
+	RoomService(ctx context.Context, roomID string) (int, error)
+	// AssignRoom takes a slot of the agent for the session of the room and
+	// returns the agent's new customer count
+	AssignRoom(ctx context.Context, roomID string, serviceID int, agentID string) (int, error)
+	// SetRoomAgent records who serves the session of the room without
+	// touching the customer counts
+	SetRoomAgent(ctx context.Context, roomID string, serviceID int, agentID string) error
+	// MappedRoomIDs lists the rooms some agent serves
+	MappedRoomIDs(ctx context.Context) ([]string, error)
+	// ForgetRoom forgets who serves the room without touching the customer
+	// counts
+	ForgetRoom(ctx context.Context, roomID string) error
+	// ReleaseRoom gives the agent's slot back and forgets who serves the
+	// room unless a later session took it over, serviceID 0 matches any
+	// session. It returns the agent's new customer count
+	ReleaseRoom(ctx context.Context, roomID string, serviceID int, agentID string) (int, error)
+	// MoveRoom hands the room and its slot to another agent at once and
+	// returns the new customer counts of both
+	MoveRoom(ctx context.Context, roomID, fromAgentID, toAgentID string) (int, int, error)
+
+	DrainingAgents(ctx context.Context) (map[string]struct{}, error)
+	SetDraining(ctx context.Context, agentID string, draining bool) error
+	IsDraining(ctx context.Context, agentID string) (bool, error)
+}
+
+// RoomStore keeps the short lived state of the rooms: when they were
+// queued, their activity and the rooms parked outside business hours. The
+// getters return ErrNotFound for unknown rooms.
+type RoomStore interface {
+	SetEnqueuedAt(ctx context.Context, roomID string, t time.Time) error
+	EnqueuedAt(ctx context.Context, roomID string) (time.Time, error)
+	// SetArrivedAt keeps when the room started waiting for an agent, which
+	// is its park time for rooms that were parked
+	SetArrivedAt(ctx context.Context, roomID string, t time.Time) error
+	ArrivedAt(ctx context.Context, roomID string) (time.Time, error)
+
+	SetLastActivity(ctx context.Context, roomID string, t time.Time) error
+	LastActivity(ctx context.Context, roomID string) (time.Time, error)
+	SetLastCommentID(ctx context.Context, roomID, commentID string) error
+	LastCommentID(ctx context.Context, roomID string) (string, error)
+	SetIdleChain(ctx context.Context, roomID, chain string) error
+	IdleChain(ctx context.Context, roomID string) (string, error)
+	// ClearActivity forgets the activity, last comment and idle chain
+	ClearActivity(ctx context.Context, roomID string) error
+
+	// SetFirstResponse keeps the first time of the service session only, a
+	// re-opened room starts without one
+	SetFirstResponse(ctx context.Context, roomID string, serviceID int, t time.Time) error
+	FirstResponseAt(ctx context.Context, roomID string, serviceID int) (time.Time, error)
+	ClearFirstResponse(ctx context.Context, roomID string, serviceID int) error
+
+	// RecordResolve remembers a room left its agent at t, for the estimated
+	// wait, ResolvesSince counts them
+	RecordResolve(ctx context.Context, roomID string, t time.Time) error
+	ResolvesSince(ctx context.Context, since time.Time) (int, error)
+	// QueueMessages returns how many queue messages the session of the room
+	// got and when the last one was sent
+	QueueMessages(ctx context.Context, roomID string, serviceID int) (int, time.Time, error)
+	RecordQueueMessage(ctx context.Context, roomID string, serviceID int, t time.Time) error
+	// TakeQueueMessage counts a queue message of the tenant and returns how
+	// many were sent in the minute of t
+	TakeQueueMessage(ctx context.Context, t time.Time) (int, error)
+
+	// SetAbandoned marks the service session of the room as resolved before
+	// it got an agent, 0 matches any session
+	SetAbandoned(ctx context.Context, roomID string, serviceID int) error
+	IsAbandoned(ctx context.Context, roomID string, serviceID int) (bool, error)
+
+	// ParkRoom also keeps at as the arrival of the room
+	ParkRoom(ctx context.Context, wimr *WebhookIncomingMessageRequest, at time.Time) error
+	// ParkedRoomIDs lists the parked rooms, first parked first
+	ParkedRoomIDs(ctx context.Context) ([]string, error)
+	ParkedRoom(ctx context.Context, roomID string) (*WebhookIncomingMessageRequest, error)
+	UnparkRoom(ctx context.Context, roomID string) error
+}
+
+// ChatRepository stores the chats, shifts and assignment history of the
+// tenant. Writes that must happen together go through a ChatTx.
+type ChatRepository interface {
+	Begin(ctx context.Context) (ChatTx, error)
+
+	// IsChatSessionExists is the ChatTx check outside of a transaction
+	IsChatSessionExists(ctx context.Context, roomID string, serviceID int) (bool, error)
+	// GetChat returns the latest session of the room, ErrNotFound for
+	// rooms we never saw
+	GetChat(ctx context.Context, roomID string) (*WebhookIncomingMessageRequest, error)
+	// AbandonChat upserts the session as abandoned unless it was served
+	AbandonChat(ctx context.Context, wimr *WebhookIncomingMessageRequest, wait *time.Duration) error
+	// AbandonmentStats counts the chats created in [from, to)
+	AbandonmentStats(ctx context.Context, from, to time.Time) (*AbandonmentStats, error)
+	// ListAssignments returns the history of one service session of the
+	// room, or of all its sessions when serviceID is 0
+	ListAssignments(ctx context.Context, roomID string, serviceID int) ([]Assignment, error)
+
+	// ListShifts returns the shifts overlapping [from, to), optionally of a
+	// single agent when agentID is above zero
+	ListShifts(ctx context.Context, agentID int, from, to time.Time) ([]AgentShift, error)
+	DeleteShift(ctx context.Context, shiftID int) (bool, error)
+	// OnShiftAgentIDs returns the agents that can take a new chat at now
+	OnShiftAgentIDs(ctx context.Context, now, cutoff time.Time) (map[string]struct{}, error)
+}
+
+type ChatTx interface {
+	// IsChatSessionExists reports whether the service session of the room
+	// was seen, a room gets a new session each time it is re-opened
+	IsChatSessionExists(ctx context.Context, roomID string, serviceID int) (bool, error)
+	CreateChat(ctx context.Context, wimr *WebhookIncomingMessageRequest) error
+	UpdateChat(ctx context.Context, wimr *WebhookIncomingMessageRequest) error
+	CreateAssignment(ctx context.Context, a *Assignment) error
+	CreateShift(ctx context.Context, shift *AgentShift) error
+	IncrementShiftAssignedChats(ctx context.Context, agentID int, now time.Time) error
+
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+// QiscusClient is the part of the Qiscus Multichannel API we use.
+type QiscusClient interface {
+	GetAllAgents(ctx context.Context) (*GetAllAgentResponse, error)
+	GetAvailableAgents(ctx context.Context, roomID string) (*GetAvailableAgentResponse, error)
+	AssignAgent(ctx context.Context, roomID string, agentID int) (*AssignAgentResponse, error)
+	RemoveAgent(ctx context.Context, roomID string, agentID int) error
+	AllocateAssignAgent(ctx context.Context, roomID string) (*AllocateAssignAgentResponse, error)
+	Resolve(ctx context.Context, roomID, notes, lastCommentID string) error
+	SendBotMessage(ctx context.Context, roomID, message string) error
+	SendMessage(ctx context.Context, m *SendMessageRequest) error
+	GetRoom(ctx context.Context, roomID string) (*CustomerRoom, error)
+	ListRooms(ctx context.Context, serveStatus string) ([]CustomerRoom, error)
+	AddRoomTags(ctx context.Context, roomID string, tags ...string) error
+
+	GetWebhookConfig(ctx context.Context) (*WebhookConfigResponse, error)
+	SetWebhookIncomingMessage(ctx context.Context, webhookUrl string) (*SetWebHookResponse, error)
+	SetWebhookMarkAsResolved(ctx context.Context, webhookUrl string) (*SetWebHookResponse, error)
+}
+
+// TaskQueue enqueues tasks and manages the queues, asynq in production.
+type TaskQueue interface {
+	Enqueue(ctx context.Context, task *asynq.Task, opts ...asynq.Option) (*asynq.TaskInfo, error)
+	GetQueueInfo(queue string) (*asynq.QueueInfo, error)
+	// ListTasks lists the tasks of the queue in state, one of pending,
+	// active, scheduled, retry or archived
+	ListTasks(queue, state string, opts ...asynq.ListOption) ([]*asynq.TaskInfo, error)
+	DeleteTask(queue, taskID string) error
+	PauseQueue(queue string) error
+	UnpauseQueue(queue string) error
+}
+
+// EventBus broadcasts the events of the tenant to the dashboards.
+type EventBus interface {
+	Publish(ctx context.Context, ev Event) error
+	// Subscribe delivers the events published from now on until ctx is done
+	Subscribe(ctx context.Context) (<-chan Event, error)
+}
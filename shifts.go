@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// onShiftAgents returns the agents whose shift allows a new chat right now.
+// A nil map means shifts are disabled and every agent is eligible.
+func (s *Service) onShiftAgents(ctx context.Context) (map[string]struct{}, error) {
+	shifts := s.conf().Shifts
+	if !shifts.Enabled {
+		return nil, nil
+	}
+
+	now := time.Now()
+	agentIDs, err := s.Chats.OnShiftAgentIDs(ctx, now, now.Add(shifts.WindDown))
+	if err != nil {
+		return nil, fmt.Errorf("error getting on shift agents: %w", err)
+	}
+
+	return agentIDs, nil
+}
+
+func isOnShift(onShift map[string]struct{}, agentID string) bool {
+	if onShift == nil {
+		return true
+	}
+
+	_, ok := onShift[agentID]
+	return ok
+}
+
+func (s *Service) HandleListShifts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	agentID, _ := strconv.Atoi(query.Get("agent_id"))
+
+	from := time.Now().Truncate(24 * time.Hour)
+	if s := query.Get("from"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "from must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+
+	to := from.Add(7 * 24 * time.Hour)
+	if s := query.Get("to"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "to must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+
+	shifts, err := s.Chats.ListShifts(r.Context(), agentID, from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list shifts: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, shifts)
+}
+
+func (s *Service) HandleCreateShift(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var shift AgentShift
+	err = json.Unmarshal(body, &shift)
+	if err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	if shift.AgentID <= 0 {
+		http.Error(w, "agent_id is required", http.StatusBadRequest)
+		return
+	}
+	if !shift.EndsAt.After(shift.StartsAt) {
+		http.Error(w, "ends_at must be after starts_at", http.StatusBadRequest)
+		return
+	}
+	for _, b := range shift.Breaks {
+		if !b.EndsAt.After(b.StartsAt) || b.StartsAt.Before(shift.StartsAt) || b.EndsAt.After(shift.EndsAt) {
+			http.Error(w, "breaks must end after they start and be inside the shift", http.StatusBadRequest)
+			return
+		}
+	}
+	shift.AssignedChats = 0
+
+	tx, err := s.Chats.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create shift: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.CreateShift(ctx, &shift)
+	if err != nil {
+		tx.Rollback(ctx)
+		http.Error(w, fmt.Sprintf("Failed to create shift: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create shift: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, shift)
+}
+
+func (s *Service) HandleDeleteShift(w http.ResponseWriter, r *http.Request) {
+	shiftID, err := strconv.Atoi(chi.URLParam(r, "shift_id"))
+	if err != nil {
+		http.Error(w, "Invalid shift id", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.Chats.DeleteShift(r.Context(), shiftID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete shift: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Shift not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
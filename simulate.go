@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// simChat is a chat of the history. agentID and assignedAt are what really
+// happened, when known.
+type simChat struct {
+	wimr       WebhookIncomingMessageRequest
+	arrivedAt  time.Time
+	handleTime time.Duration
+	agentID    int
+	assignedAt time.Time
+}
+
+// simWindow is a time an agent was online, a zero to never ends.
+type simWindow struct {
+	from, to time.Time
+}
+
+type simHistory struct {
+	chats  []simChat
+	agents map[int][]simWindow
+}
+
+// loadSimHistoryPostgres reads the chats of the period. A chat row is only
+// written once the room is assigned, so a chat arrives when Qiscus opened
+// its session.
+func loadSimHistoryPostgres(ctx context.Context, chats *pgChats, from, to time.Time) (*simHistory, error) {
+	rows, err := chats.ListChatHistory(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chat history: %w", err)
+	}
+
+	h := &simHistory{}
+	for _, row := range rows {
+		h.chats = append(h.chats, simChat{
+			wimr:       row.Chat,
+			arrivedAt:  chatArrival(row),
+			agentID:    row.AgentID,
+			assignedAt: row.AssignedAt,
+		})
+	}
+
+	sort.SliceStable(h.chats, func(i, j int) bool { return h.chats[i].arrivedAt.Before(h.chats[j].arrivedAt) })
+	return h, nil
+}
+
+// chatArrival is the start of the service session, the chat row's creation
+// for sessions without a readable one.
+func chatArrival(row ChatHistory) time.Time {
+	t, err := time.Parse(time.RFC3339, row.Chat.LatestService.CreatedAt)
+	if err != nil || t.After(row.CreatedAt) {
+		return row.CreatedAt
+	}
+
+	return t
+}
+
+// loadSimHistoryJSONL reads a webhook recording. A recorded resolve sets the
+// handle time of the chat, from its arrival as the assignment time is not
+// recorded.
+func loadSimHistoryJSONL(path, appID string) (*simHistory, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	h := &simHistory{}
+	open := map[string]int{}
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var rw RecordedWebhook
+		if err := json.Unmarshal(scanner.Bytes(), &rw); err != nil {
+			continue
+		}
+		body, err := rw.body()
+		if err != nil {
+			continue
+		}
+
+		path, _, _ := strings.Cut(rw.Path, "?")
+		switch path {
+		case WEBHOOK_INCOMING_MESSAGE_PATH:
+			var wimr WebhookIncomingMessageRequest
+			if err := json.Unmarshal(body, &wimr); err != nil || wimr.RoomID == "" {
+				continue
+			}
+			if appID != "" && wimr.AppID != "" && wimr.AppID != appID {
+				continue
+			}
+			// Qiscus may send the webhook of a room again
+			if _, ok := open[wimr.RoomID]; ok {
+				continue
+			}
+
+			open[wimr.RoomID] = len(h.chats)
+			h.chats = append(h.chats, simChat{wimr: wimr, arrivedAt: rw.Time})
+
+		case WEBHOOK_MARK_AS_RESOLVED_PATH:
+			var data WebhookMarkAsResolvedRequest
+			if err := json.Unmarshal(body, &data); err != nil {
+				continue
+			}
+
+			i, ok := open[data.Service.RoomID]
+			if !ok {
+				continue
+			}
+			h.chats[i].handleTime = rw.Time.Sub(h.chats[i].arrivedAt)
+			h.chats[i].agentID = data.ResolvedBy.ID
+			delete(open, data.Service.RoomID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	sort.SliceStable(h.chats, func(i, j int) bool { return h.chats[i].arrivedAt.Before(h.chats[j].arrivedAt) })
+	return h, nil
+}
+
+// setAgents builds the availability timelines from the config, else from the
+// shifts, else every agent of the history is online from the first chat on.
+func (h *simHistory) setAgents(agents []simAgentConfig, shifts []AgentShift) {
+	start := h.chats[0].arrivedAt
+	h.agents = map[int][]simWindow{}
+
+	switch {
+	case len(agents) > 0:
+		for _, a := range agents {
+			if len(a.Online) == 0 {
+				h.agents[a.ID] = []simWindow{{from: start}}
+				continue
+			}
+			for _, w := range a.Online {
+				h.agents[a.ID] = append(h.agents[a.ID], simWindow{from: w.From, to: w.To})
+			}
+		}
+
+	case len(shifts) > 0:
+		for _, shift := range shifts {
+			breaks := append([]ShiftBreak{}, shift.Breaks...)
+			sort.Slice(breaks, func(i, j int) bool { return breaks[i].StartsAt.Before(breaks[j].StartsAt) })
+
+			from := shift.StartsAt
+			for _, b := range breaks {
+				if b.StartsAt.After(from) {
+					h.agents[shift.AgentID] = append(h.agents[shift.AgentID], simWindow{from: from, to: b.StartsAt})
+				}
+				if b.EndsAt.After(from) {
+					from = b.EndsAt
+				}
+			}
+			if shift.EndsAt.After(from) {
+				h.agents[shift.AgentID] = append(h.agents[shift.AgentID], simWindow{from: from, to: shift.EndsAt})
+			}
+		}
+
+	default:
+		for _, chat := range h.chats {
+			if chat.agentID > 0 {
+				h.agents[chat.agentID] = []simWindow{{from: start}}
+			}
+		}
+	}
+}
+
+// fillHandleTimes draws the missing handle times. The draws are the same on
+// every run, so the strategies see the same chats.
+func (h *simHistory) fillHandleTimes(hc handleTimeConfig) {
+	rnd := rand.New(rand.NewPCG(1, 1))
+	for i := range h.chats {
+		if h.chats[i].handleTime <= 0 {
+			h.chats[i].handleTime = hc.sample(rnd)
+		}
+	}
+}
+
+type simResult struct {
+	Strategy string
+	Capacity uint
+	Rooms    int
+	Assigned int
+	// Waits are sorted
+	Waits []time.Duration
+	// Utilization and Fairness are below zero when unknown
+	Utilization float64
+	Fairness    float64
+	MinChats    int
+	MaxChats    int
+}
+
+// result is what really happened, for the chats with a known assignment.
+func (h *simHistory) result() simResult {
+	res := simResult{Strategy: "history", Rooms: len(h.chats), Utilization: -1, Fairness: -1}
+
+	perAgent := map[int]int{}
+	for _, chat := range h.chats {
+		if chat.assignedAt.IsZero() {
+			continue
+		}
+
+		res.Assigned++
+		res.Waits = append(res.Waits, max(chat.assignedAt.Sub(chat.arrivedAt), 0))
+		perAgent[chat.agentID]++
+	}
+	sort.Slice(res.Waits, func(i, j int) bool { return res.Waits[i] < res.Waits[j] })
+	res.MinChats, res.MaxChats = chatsRange(perAgent)
+
+	return res
+}
+
+func chatsRange(perAgent map[int]int) (int, int) {
+	minChats, maxChats := -1, 0
+	for _, n := range perAgent {
+		if minChats < 0 || n < minChats {
+			minChats = n
+		}
+		maxChats = max(maxChats, n)
+	}
+
+	return max(minChats, 0), maxChats
+}
+
+const (
+	// Events at the same time are handled in this order
+	simResolve = iota
+	simOnline
+	simOffline
+	simArrival
+)
+
+type simEvent struct {
+	at      time.Time
+	kind    int
+	seq     int
+	chat    int
+	agentID int
+}
+
+type simEvents []simEvent
+
+func (e simEvents) Len() int { return len(e) }
+
+func (e simEvents) Less(i, j int) bool {
+	if !e[i].at.Equal(e[j].at) {
+		return e[i].at.Before(e[j].at)
+	}
+	if e[i].kind != e[j].kind {
+		return e[i].kind < e[j].kind
+	}
+	return e[i].seq < e[j].seq
+}
+
+func (e simEvents) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+func (e *simEvents) Push(x any) { *e = append(*e, x.(simEvent)) }
+
+func (e *simEvents) Pop() any {
+	old := *e
+	ev := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return ev
+}
+
+type simAgentStats struct {
+	online     bool
+	count      int
+	chats      int
+	onlineTime time.Duration
+	// slotSeconds is the customer count integrated over the online time
+	slotSeconds float64
+}
+
+// simulator replays a history through the allocation code of a Service
+// with in memory stores and a virtual clock.
+type simulator struct {
+	conf    *config
+	history *simHistory
+}
+
+func (sim *simulator) run(ctx context.Context, strategy string, capacity uint) simResult {
+	c := *sim.conf
+	c.Tenants = nil
+	c.byTenant = nil
+	c.Allocation.Backend = strategy
+	c.WebhookConfig.MaxCurrentCustomer = capacity
+	// The shifts are part of the availability timelines
+	c.Shifts.Enabled = false
+
+	store := newMemAgentStore()
+	stats := map[int]*simAgentStats{}
+	for id := range sim.history.agents {
+		idStr := strconv.Itoa(id)
+		store.AddAgent(ctx, idStr, nil)
+		store.SetCustomerCount(ctx, idStr, 0)
+		stats[id] = &simAgentStats{}
+	}
+
+	s := &Service{
+		Agents: store,
+		Qiscus: &simQiscus{agents: store, capacity: int(capacity)},
+		config: newConfigHolder(&c),
+	}
+
+	events := &simEvents{}
+	seq := 0
+	push := func(ev simEvent) {
+		ev.seq = seq
+		seq++
+		heap.Push(events, ev)
+	}
+
+	for i, chat := range sim.history.chats {
+		push(simEvent{at: chat.arrivedAt, kind: simArrival, chat: i})
+	}
+	for id, windows := range sim.history.agents {
+		for _, w := range windows {
+			push(simEvent{at: w.from, kind: simOnline, agentID: id})
+			if !w.to.IsZero() {
+				push(simEvent{at: w.to, kind: simOffline, agentID: id})
+			}
+		}
+	}
+
+	res := simResult{Strategy: strategy, Capacity: capacity, Rooms: len(sim.history.chats)}
+
+	var now time.Time
+	var waiting []int
+	for events.Len() > 0 {
+		ev := heap.Pop(events).(simEvent)
+
+		if !now.IsZero() {
+			dt := ev.at.Sub(now)
+			for _, st := range stats {
+				if st.online {
+					st.onlineTime += dt
+					st.slotSeconds += float64(st.count) * dt.Seconds()
+				}
+			}
+		}
+		now = ev.at
+
+		switch ev.kind {
+		case simArrival:
+			waiting = append(waiting, ev.chat)
+		case simOnline, simOffline:
+			online := ev.kind == simOnline
+			store.SetOnline(ctx, strconv.Itoa(ev.agentID), online)
+			stats[ev.agentID].online = online
+		case simResolve:
+			roomID := sim.history.chats[ev.chat].wimr.RoomID
+			store.ReleaseRoom(ctx, roomID, sim.history.chats[ev.chat].wimr.LatestService.ID, strconv.Itoa(ev.agentID))
+			stats[ev.agentID].count--
+		}
+
+		// Rooms are served in order, like the single worker of the queue
+		for len(waiting) > 0 {
+			chat := &sim.history.chats[waiting[0]]
+			wimr := chat.wimr
+
+			agentID, err := sim.allocate(ctx, s, &wimr, capacity)
+			if err != nil {
+				break
+			}
+			st, ok := stats[agentID]
+			if !ok {
+				break
+			}
+
+			store.AssignRoom(ctx, wimr.RoomID, wimr.LatestService.ID, strconv.Itoa(agentID))
+			st.count++
+			st.chats++
+
+			res.Assigned++
+			res.Waits = append(res.Waits, now.Sub(chat.arrivedAt))
+			push(simEvent{at: now.Add(chat.handleTime), kind: simResolve, chat: waiting[0], agentID: agentID})
+			waiting = waiting[1:]
+		}
+	}
+
+	sort.Slice(res.Waits, func(i, j int) bool { return res.Waits[i] < res.Waits[j] })
+
+	var slotSeconds, offeredSeconds, sum, sumSquares float64
+	perAgent := map[int]int{}
+	n := 0
+	for id, st := range stats {
+		if st.onlineTime <= 0 {
+			continue
+		}
+
+		slotSeconds += st.slotSeconds
+		offeredSeconds += st.onlineTime.Seconds() * float64(capacity)
+
+		// Chats per online hour, agents online longer should get more
+		x := float64(st.chats) / st.onlineTime.Hours()
+		sum += x
+		sumSquares += x * x
+		n++
+		perAgent[id] = st.chats
+	}
+
+	res.Utilization = -1
+	if offeredSeconds > 0 {
+		res.Utilization = slotSeconds / offeredSeconds
+	}
+	// Jain's fairness index, 1 when every agent gets the same share
+	res.Fairness = -1
+	if sumSquares > 0 {
+		res.Fairness = sum * sum / (float64(n) * sumSquares)
+	}
+	res.MinChats, res.MaxChats = chatsRange(perAgent)
+
+	return res
+}
+
+// allocate runs the allocation of the strategy once. The Redis backend
+// retries in real time, so its single pass is called directly, and the
+// waiting is done by the simulation.
+func (sim *simulator) allocate(ctx context.Context, s *Service, wimr *WebhookIncomingMessageRequest, capacity uint) (int, error) {
+	switch s.conf().Allocation.Backend {
+	case BackendRedis:
+		agentID, err := s.FindAvailableAgent(ctx, wimr.RoomID, int(capacity))
+		if err != nil {
+			return 0, err
+		}
+		if agentID == "" {
+			return 0, errors.New("no agent available")
+		}
+		return s.assignAgentID(ctx, wimr, agentID)
+
+	case BackendQiscusCandidate:
+		// The recorded candidate was picked for the real load
+		wimr.CandidateAgent.ID = s.Qiscus.(*simQiscus).leastBusy(ctx, 0)
+	}
+
+	agentID, _, err := s.AllocateAgent(ctx, wimr)
+	return agentID, err
+}
+
+var errNotSimulated = errors.New("not simulated")
+
+// simQiscus answers the allocation calls of a simulated Service from its
+// agent store, the way Qiscus would.
+type simQiscus struct {
+	agents   *memAgentStore
+	capacity int
+}
+
+// leastBusy returns the online agent with the fewest customers below limit,
+// or 0. A limit of 0 means no limit, like the candidate of the allocate
+// webhook.
+func (q *simQiscus) leastBusy(ctx context.Context, limit int) int {
+	ids, _ := q.agents.AgentIDs(ctx)
+
+	best, bestCount := 0, 0
+	for _, id := range ids {
+		if online, _ := q.agents.IsOnline(ctx, id); !online {
+			continue
+		}
+
+		count, _ := q.agents.CustomerCount(ctx, id)
+		if limit > 0 && count >= limit {
+			continue
+		}
+		if best == 0 || count < bestCount {
+			best, _ = strconv.Atoi(id)
+			bestCount = count
+		}
+	}
+
+	return best
+}
+
+func (q *simQiscus) GetAllAgents(ctx context.Context) (*GetAllAgentResponse, error) {
+	ids, _ := q.agents.AgentIDs(ctx)
+
+	var res GetAllAgentResponse
+	for _, id := range ids {
+		agentID, _ := strconv.Atoi(id)
+		online, _ := q.agents.IsOnline(ctx, id)
+		count, _ := q.agents.CustomerCount(ctx, id)
+		res.Data.Agents = append(res.Data.Agents, Agent{ID: agentID, IsAvailable: online, CurrentCustomerCount: count})
+	}
+
+	return &res, nil
+}
+
+func (q *simQiscus) GetAvailableAgents(ctx context.Context, roomID string) (*GetAvailableAgentResponse, error) {
+	all, _ := q.GetAllAgents(ctx)
+
+	var res GetAvailableAgentResponse
+	for _, a := range all.Data.Agents {
+		if a.IsAvailable {
+			res.Data.Agents = append(res.Data.Agents, AvailableAgent(a))
+		}
+	}
+
+	return &res, nil
+}
+
+func (q *simQiscus) AssignAgent(ctx context.Context, roomID string, agentID int) (*AssignAgentResponse, error) {
+	var res AssignAgentResponse
+	res.Data.AddedAgent.ID = agentID
+	return &res, nil
+}
+
+func (q *simQiscus) RemoveAgent(ctx context.Context, roomID string, agentID int) error {
+	return nil
+}
+
+func (q *simQiscus) AllocateAssignAgent(ctx context.Context, roomID string) (*AllocateAssignAgentResponse, error) {
+	var res AllocateAssignAgentResponse
+	res.Data.Agent.ID = q.leastBusy(ctx, q.capacity)
+	return &res, nil
+}
+
+func (q *simQiscus) Resolve(ctx context.Context, roomID, notes, lastCommentID string) error {
+	return nil
+}
+
+func (q *simQiscus) SendBotMessage(ctx context.Context, roomID, message string) error {
+	return nil
+}
+
+func (q *simQiscus) SendMessage(ctx context.Context, m *SendMessageRequest) error {
+	return nil
+}
+
+func (q *simQiscus) GetRoom(ctx context.Context, roomID string) (*CustomerRoom, error) {
+	return nil, errNotSimulated
+}
+
+func (q *simQiscus) ListRooms(ctx context.Context, serveStatus string) ([]CustomerRoom, error) {
+	return nil, errNotSimulated
+}
+
+func (q *simQiscus) AddRoomTags(ctx context.Context, roomID string, tags ...string) error {
+	return nil
+}
+
+func (q *simQiscus) GetWebhookConfig(ctx context.Context) (*WebhookConfigResponse, error) {
+	return nil, errNotSimulated
+}
+
+func (q *simQiscus) SetWebhookIncomingMessage(ctx context.Context, webhookUrl string) (*SetWebHookResponse, error) {
+	return nil, errNotSimulated
+}
+
+func (q *simQiscus) SetWebhookMarkAsResolved(ctx context.Context, webhookUrl string) (*SetWebHookResponse, error) {
+	return nil, errNotSimulated
+}
+
+func printSimResults(w io.Writer, h *simHistory, results []simResult) {
+	first, last := h.chats[0].arrivedAt, h.chats[len(h.chats)-1].arrivedAt
+	fmt.Fprintf(w, "%d chats from %s to %s, %d agents\n\n", len(h.chats), first.Format(time.RFC3339), last.Format(time.RFC3339), len(h.agents))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STRATEGY\tCAPACITY\tASSIGNED\tWAIT MEAN\tP50\tP90\tP99\tMAX\tUTILIZATION\tFAIRNESS\tCHATS PER AGENT")
+
+	for _, r := range results {
+		capacity := "-"
+		if r.Capacity > 0 {
+			capacity = strconv.Itoa(int(r.Capacity))
+		}
+
+		var total time.Duration
+		for _, wait := range r.Waits {
+			total += wait
+		}
+		mean := time.Duration(0)
+		if len(r.Waits) > 0 {
+			mean = total / time.Duration(len(r.Waits))
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d-%d\n",
+			r.Strategy, capacity, r.Assigned, r.Rooms,
+			mean.Round(time.Second),
+			percentile(r.Waits, 0.50).Round(time.Second),
+			percentile(r.Waits, 0.90).Round(time.Second),
+			percentile(r.Waits, 0.99).Round(time.Second),
+			percentile(r.Waits, 1).Round(time.Second),
+			simRatio(r.Utilization, "%.0f%%", 100),
+			simRatio(r.Fairness, "%.2f", 1),
+			r.MinChats, r.MaxChats)
+	}
+
+	tw.Flush()
+}
+
+func simRatio(v float64, format string, scale float64) string {
+	if v < 0 {
+		return "-"
+	}
+	return fmt.Sprintf(format, v*scale)
+}
+
+func runSimulate(c *config) {
+	ctx := context.Background()
+	sc := c.Simulate
+	conf := c.tenant(sc.Tenant)
+
+	var history *simHistory
+	var shifts []AgentShift
+	var err error
+
+	switch sc.Source {
+	case "jsonl":
+		history, err = loadSimHistoryJSONL(sc.Path, conf.QiscusConfig.AppID)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	default:
+		to := sc.To
+		if to.IsZero() {
+			to = time.Now()
+		}
+		from := sc.From
+		if from.IsZero() {
+			from = to.Add(-7 * 24 * time.Hour)
+		}
+
+		pool, err := pgxpool.New(ctx, c.DBConfig.ConnectionString)
+		if err != nil {
+			log.Fatalf("Error connecting to database: %v", err)
+		}
+		defer pool.Close()
+
+		chats := newPgChats(pool, sc.Tenant)
+		history, err = loadSimHistoryPostgres(ctx, chats, from, to)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(sc.Agents) == 0 {
+			shifts, err = chats.ListShifts(ctx, 0, from, to)
+			if err != nil {
+				log.Fatalf("Failed to read shifts: %v", err)
+			}
+		}
+	}
+
+	if len(history.chats) == 0 {
+		log.Fatal("No chats to simulate")
+	}
+
+	history.setAgents(sc.Agents, shifts)
+	if len(history.agents) == 0 {
+		log.Fatal("No agents to simulate, configure simulate.agents")
+	}
+	history.fillHandleTimes(sc.HandleTime)
+
+	strategies := sc.Strategies
+	if len(strategies) == 0 {
+		strategies = []string{conf.Allocation.Backend}
+	}
+	capacities := sc.Capacities
+	if len(capacities) == 0 {
+		capacities = []uint{conf.WebhookConfig.MaxCurrentCustomer}
+	}
+
+	var results []simResult
+	if hist := history.result(); hist.Assigned > 0 {
+		results = append(results, hist)
+	}
+
+	// The allocation code logs every decision
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+
+	sim := &simulator{conf: conf, history: history}
+	for _, strategy := range strategies {
+		for _, capacity := range capacities {
+			results = append(results, sim.run(ctx, strategy, capacity))
+		}
+	}
+
+	log.SetOutput(out)
+
+	printSimResults(os.Stdout, history, results)
+}
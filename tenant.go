@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/hibiken/asynq"
+	"gopkg.in/yaml.v2"
+)
+
+// A tenant is one Qiscus app served by this deployment. The default tenant
+// is the top level qiscus section, it keeps the un-namespaced Redis keys and
+// queues and an empty tenant column so existing deployments keep working.
+// Every other tenant is the top level config with its overrides applied.
+
+// tenantSections are the top level sections a tenant may override
+var tenantSections = map[string]struct{}{
+	"qiscus":         {},
+	"webhook":        {},
+	"queue":          {},
+	"business_hours": {},
+	"shifts":         {},
+	"auto_resolve":   {},
+	"sla":            {},
+	"allocation":     {},
+	"queue_messages": {},
+}
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+const (
+	// defaultTenantName names the default tenant where a name is needed,
+	// like the tenants of an admin key
+	defaultTenantName = "default"
+	anyTenant         = "*"
+)
+
+type tenantConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Overrides holds the overridden sections as written in the file
+	Overrides map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+func (c *config) queue(name string) string {
+	if c.name == "" {
+		return name
+	}
+
+	return c.name + ":" + name
+}
+
+// tenant returns the effective config of the named tenant. Unknown names
+// fall back to the default tenant.
+func (c *config) tenant(name string) *config {
+	if t, ok := c.byTenant[name]; ok {
+		return t
+	}
+
+	return c
+}
+
+// allTenants returns the default tenant followed by the configured ones.
+func (c *config) allTenants() []*config {
+	all := []*config{c}
+	for _, tc := range c.Tenants {
+		all = append(all, c.tenant(tc.Name))
+	}
+
+	return all
+}
+
+// buildTenants applies the overrides of every tenant to a copy of the top
+// level config.
+func (c *config) buildTenants() error {
+	base := *c
+	base.Tenants = nil
+	base.byTenant = nil
+
+	shared, err := yaml.Marshal(base)
+	if err != nil {
+		return err
+	}
+
+	tenants := make(map[string]*config, len(c.Tenants))
+	for _, tc := range c.Tenants {
+		for section := range tc.Overrides {
+			if _, ok := tenantSections[section]; !ok {
+				return fmt.Errorf("tenants.%s: %s cannot be set per tenant", tc.Name, section)
+			}
+		}
+
+		t := config{}
+		if err := yaml.Unmarshal(shared, &t); err != nil {
+			return err
+		}
+		// Credentials belong to a single app and are never inherited
+		t.QiscusConfig = defaultQiscusConfig()
+
+		overrides, err := yaml.Marshal(tc.Overrides)
+		if err != nil {
+			return fmt.Errorf("tenants.%s: %w", tc.Name, err)
+		}
+		if err := yaml.UnmarshalStrict(overrides, &t); err != nil {
+			return fmt.Errorf("tenants.%s: %w", tc.Name, err)
+		}
+
+		if err := t.resolveSecrets(); err != nil {
+			return fmt.Errorf("tenants.%s: %w", tc.Name, err)
+		}
+
+		t.name = tc.Name
+		tenants[tc.Name] = &t
+	}
+
+	c.byTenant = tenants
+	return nil
+}
+
+func (c *config) validateTenants() error {
+	var errs []error
+
+	appIDs := map[string]string{c.QiscusConfig.AppID: "the default tenant"}
+	names := map[string]struct{}{}
+	for i, tc := range c.Tenants {
+		if !tenantNamePattern.MatchString(tc.Name) {
+			errs = append(errs, fmt.Errorf("tenants[%d].name %q must only use a-z, 0-9, _ and -", i, tc.Name))
+			continue
+		}
+		if tc.Name == defaultTenantName {
+			errs = append(errs, fmt.Errorf("tenants[%d].name %q is reserved for the default tenant", i, tc.Name))
+			continue
+		}
+		if _, ok := names[tc.Name]; ok {
+			errs = append(errs, fmt.Errorf("tenants[%d].name %q is used twice", i, tc.Name))
+			continue
+		}
+		names[tc.Name] = struct{}{}
+
+		t := c.tenant(tc.Name)
+		if err := t.validateTenantSections(); err != nil {
+			errs = append(errs, fmt.Errorf("tenants.%s:\n%w", tc.Name, err))
+		}
+
+		if other, ok := appIDs[t.QiscusConfig.AppID]; ok {
+			errs = append(errs, fmt.Errorf("tenants.%s: qiscus.app_id is also used by %s", tc.Name, other))
+		}
+		appIDs[t.QiscusConfig.AppID] = "tenant " + tc.Name
+	}
+
+	return errors.Join(errs...)
+}
+
+// tenantNames lists the names of the configured tenants, in order.
+func (c *config) tenantNames() []string {
+	names := make([]string, len(c.Tenants))
+	for i, tc := range c.Tenants {
+		names[i] = tc.Name
+	}
+
+	return names
+}
+
+// Tenants holds the Service of every tenant, the default tenant first.
+type Tenants []*Service
+
+func (ts Tenants) ByName(name string) (*Service, bool) {
+	for _, s := range ts {
+		if s.Tenant == name {
+			return s, true
+		}
+	}
+
+	return nil, false
+}
+
+func (ts Tenants) ByAppID(appID string) (*Service, bool) {
+	for _, s := range ts {
+		if s.conf().QiscusConfig.AppID == appID {
+			return s, true
+		}
+	}
+
+	return nil, false
+}
+
+// HTTP routes the request to the tenant of its app_id query parameter, the
+// default tenant when there is none.
+func (ts Tenants) HTTP(h func(*Service, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appID := r.URL.Query().Get("app_id")
+		if appID == "" {
+			h(ts[0], w, r)
+			return
+		}
+
+		s, ok := ts.ByAppID(appID)
+		if !ok {
+			http.Error(w, "Unknown app_id", http.StatusNotFound)
+			return
+		}
+
+		h(s, w, r)
+	}
+}
+
+// HandleIncomingMessage routes the webhook to the tenant of the app_id of
+// its payload, which wins over the one of the webhook url.
+func (ts Tenants) HandleIncomingMessage(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// A malformed body is rejected by the handler
+	var data struct {
+		AppID string `json:"app_id"`
+	}
+	if json.Unmarshal(body, &data) != nil || data.AppID == "" {
+		ts.HTTP((*Service).HandleIncomingMessage)(w, r)
+		return
+	}
+
+	s, ok := ts.ByAppID(data.AppID)
+	if !ok {
+		http.Error(w, "Unknown app_id", http.StatusNotFound)
+		return
+	}
+
+	s.HandleIncomingMessage(w, r)
+}
+
+// Task runs the task as the tenant owning its queue.
+func (ts Tenants) Task(h func(*Service, context.Context, *asynq.Task) error) asynq.HandlerFunc {
+	return func(ctx context.Context, task *asynq.Task) error {
+		queue, _ := asynq.GetQueueName(ctx)
+
+		name := ""
+		if prefix, _, ok := strings.Cut(queue, ":"); ok {
+			name = prefix
+		}
+
+		s, ok := ts.ByName(name)
+		if !ok {
+			return fmt.Errorf("no tenant owns queue %q: %w", queue, asynq.SkipRetry)
+		}
+
+		return h(s, ctx, task)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type TransferRequest struct {
+	AgentID int    `json:"agent_id"`
+	Reason  string `json:"reason"`
+	// FromAgentID is only needed when we do not know the room's agent
+	FromAgentID int `json:"from_agent_id"`
+}
+
+func (s *Service) HandleTransferRoom(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	roomID := chi.URLParam(r, "room_id")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var data TransferRequest
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	if data.AgentID <= 0 {
+		http.Error(w, "agent_id is required", http.StatusBadRequest)
+		return
+	}
+	if data.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	roomAgent, err := s.Agents.RoomAgent(ctx, roomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		http.Error(w, "Failed to find room agent", http.StatusInternalServerError)
+		return
+	}
+	fromAgentID, _ := strconv.Atoi(roomAgent)
+	if fromAgentID == 0 {
+		fromAgentID = data.FromAgentID
+	}
+	if fromAgentID == 0 {
+		http.Error(w, "Room has no known agent, set from_agent_id", http.StatusConflict)
+		return
+	}
+	if fromAgentID == data.AgentID {
+		http.Error(w, "Room is already with this agent", http.StatusBadRequest)
+		return
+	}
+
+	known, err := s.Agents.IsAgent(ctx, strconv.Itoa(data.AgentID))
+	if err != nil {
+		http.Error(w, "Failed to find agent", http.StatusInternalServerError)
+		return
+	}
+	if !known {
+		http.Error(w, "Unknown agent", http.StatusNotFound)
+		return
+	}
+
+	actor := "unknown"
+	if p, ok := principalFromContext(ctx); ok {
+		actor = p.Name
+	}
+
+	err = s.ReassignRoom(ctx, roomID, fromAgentID, data.AgentID, AssignmentKindTransfer, data.Reason, actor, nil)
+	if err != nil {
+		log.Printf("Failed to transfer room %s: %v", roomID, err)
+		http.Error(w, fmt.Sprintf("Failed to transfer room: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("Room %s transferred from agent %d to %d by %s", roomID, fromAgentID, data.AgentID, actor)
+
+	serviceID, err := s.Agents.RoomService(ctx, roomID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		http.Error(w, "Failed to find room session", http.StatusInternalServerError)
+		return
+	}
+
+	assignments, err := s.Chats.ListAssignments(ctx, roomID, serviceID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list assignments: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, assignments)
+}
+
+func (s *Service) HandleListRoomAssignments(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "room_id")
+
+	var serviceID int
+	if v := r.URL.Query().Get("service_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			http.Error(w, "service_id must be a positive number", http.StatusBadRequest)
+			return
+		}
+		serviceID = id
+	}
+
+	assignments, err := s.Chats.ListAssignments(r.Context(), roomID, serviceID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list assignments: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, assignments)
+}
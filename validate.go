@@ -0,0 +1,587 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"gopkg.in/yaml.v2"
+)
+
+const redactedSecret = "REDACTED"
+
+var weekDays = map[string]struct{}{
+	"monday": {}, "tuesday": {}, "wednesday": {}, "thursday": {}, "friday": {}, "saturday": {}, "sunday": {},
+}
+
+func readSecretFile(fn string) (string, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// resolveSecrets replaces secrets with the content of their *_file
+// counterpart, so they can come from mounted secret files.
+func (c *config) resolveSecrets() error {
+	secrets := []struct {
+		file   string
+		result *string
+	}{
+		{c.DBConfig.ConnectionStringFile, &c.DBConfig.ConnectionString},
+		{c.QiscusConfig.SecretKeyFile, &c.QiscusConfig.SecretKey},
+		{c.QiscusConfig.PasswordFile, &c.QiscusConfig.Password},
+	}
+
+	for _, secret := range secrets {
+		if secret.file == "" {
+			continue
+		}
+
+		s, err := readSecretFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("cannot read secret file: %w", err)
+		}
+		*secret.result = s
+	}
+
+	return nil
+}
+
+func validateHTTPURL(field, s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s: %q must be an http or https url", field, s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s: %q has no host", field, s)
+	}
+
+	return nil
+}
+
+func validatePort(field string, port uint) error {
+	if port == 0 || port > 65535 {
+		return fmt.Errorf("%s: %d is not a valid port", field, port)
+	}
+
+	return nil
+}
+
+func validatePositive(field string, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("%s must be positive", field)
+	}
+
+	return nil
+}
+
+// Validate checks the sections the mode uses and reports all the problems at
+// once. The sections of the tool modes are only checked when they run.
+func (c *config) Validate() error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	check(validatePort("listen.port", c.Listen.Port))
+
+	if _, err := pgxpool.ParseConfig(c.DBConfig.ConnectionString); err != nil {
+		check(fmt.Errorf("db.connection_string is invalid: %w", err))
+	}
+
+	if _, _, err := net.SplitHostPort(c.RedisConfig.Url); err != nil {
+		check(fmt.Errorf("redis.url must be host:port: %w", err))
+	}
+
+	check(c.Admin.validate(c.tenantNames()))
+	check(c.Recorder.validate())
+
+	switch c.mode {
+	case "fake-qiscus":
+		check(c.FakeQiscus.validate())
+	case "replay":
+		check(c.Replay.validate())
+	case "loadgen":
+		check(c.Loadgen.validate())
+	case "simulate":
+		check(c.Simulate.validate(c.tenantNames()))
+	}
+	check(c.validateTenantSections())
+	check(c.validateTenants())
+
+	return errors.Join(errs...)
+}
+
+// validateTenantSections checks the sections every tenant has its own
+// version of.
+func (c *config) validateTenantSections() error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	check(validateHTTPURL("qiscus.base_url", c.QiscusConfig.BaseUrl))
+	if c.QiscusConfig.AppID == "" {
+		check(errors.New("qiscus.app_id is required"))
+	}
+	if c.QiscusConfig.SecretKey == "" {
+		check(errors.New("qiscus.secret_key is required"))
+	}
+	if (c.QiscusConfig.Email == "") != (c.QiscusConfig.Password == "") {
+		check(errors.New("qiscus.email and qiscus.password must be set together"))
+	}
+
+	check(validateHTTPURL("webhook.base_url", c.WebhookConfig.BaseUrl))
+	if c.WebhookConfig.MaxCurrentCustomer == 0 {
+		check(errors.New("webhook.max_current_customer must be at least 1"))
+	}
+
+	check(c.QueueConfig.validate())
+	check(c.BusinessHours.validate())
+	check(c.AutoResolve.validate())
+	check(c.SLA.validate())
+	check(c.QueueMessages.validate())
+
+	if c.Shifts.WindDown < 0 {
+		check(errors.New("shifts.wind_down must not be negative"))
+	}
+
+	switch c.Allocation.Backend {
+	case BackendRedis, BackendQiscusCandidate, BackendQiscusAllocate, BackendHybrid:
+	default:
+		check(fmt.Errorf("allocation.backend %q is unknown", c.Allocation.Backend))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (ac adminConfig) validate(tenants []string) error {
+	var errs []error
+
+	if ac.Port != 0 {
+		errs = append(errs, validatePort("admin.port", ac.Port))
+	}
+	if !strings.HasPrefix(ac.Prefix, "/") {
+		errs = append(errs, fmt.Errorf("admin.prefix %q must start with /", ac.Prefix))
+	}
+
+	names := map[string]struct{}{}
+	keys := map[string]struct{}{}
+	for i, k := range ac.Keys {
+		if k.Name == "" {
+			errs = append(errs, fmt.Errorf("admin.keys[%d].name is required", i))
+		} else if _, ok := names[k.Name]; ok {
+			errs = append(errs, fmt.Errorf("admin.keys[%d].name %q is used twice", i, k.Name))
+		}
+		names[k.Name] = struct{}{}
+
+		if _, err := parseRole(k.Role); err != nil {
+			errs = append(errs, fmt.Errorf("admin.keys[%d].role: %w", i, err))
+		}
+
+		for _, t := range k.Tenants {
+			if t != anyTenant && t != defaultTenantName && !slices.Contains(tenants, t) {
+				errs = append(errs, fmt.Errorf("admin.keys[%d].tenants: %q is not a configured tenant", i, t))
+			}
+		}
+
+		if len(k.Key) < 16 {
+			errs = append(errs, fmt.Errorf("admin.keys[%d].key must be at least 16 characters", i))
+		} else if _, ok := keys[k.Key]; ok {
+			errs = append(errs, fmt.Errorf("admin.keys[%d].key is used twice", i))
+		}
+		keys[k.Key] = struct{}{}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (qc queueConfig) validate() error {
+	var errs []error
+
+	errs = append(errs,
+		validatePositive("queue.backoff.initial", qc.Backoff.Initial),
+		validatePositive("queue.timeout", qc.Timeout),
+		validatePositive("queue.deadline", qc.Deadline),
+		validatePositive("queue.allocation_wait", qc.AllocationWait),
+		validatePositive("queue.allocation_retry_interval", qc.AllocationRetryInterval),
+	)
+
+	if qc.Backoff.Max < qc.Backoff.Initial {
+		errs = append(errs, errors.New("queue.backoff.max must not be below queue.backoff.initial"))
+	}
+	if qc.Backoff.Factor < 1 {
+		errs = append(errs, errors.New("queue.backoff.factor must be at least 1"))
+	}
+	if qc.Timeout <= qc.AllocationWait {
+		errs = append(errs, errors.New("queue.timeout must be longer than queue.allocation_wait"))
+	}
+
+	switch qc.Fallback.Action {
+	case "none", "escalate":
+	case "auto_reply":
+		if qc.Fallback.Message == "" {
+			errs = append(errs, errors.New("queue.fallback.message is required for auto_reply"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("queue.fallback.action %q is unknown", qc.Fallback.Action))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (bc businessHoursConfig) validate() error {
+	var errs []error
+
+	for name, ch := range bc.Channels {
+		field := "business_hours.channels." + name
+
+		if ch.Timezone != "" {
+			if _, err := time.LoadLocation(ch.Timezone); err != nil {
+				errs = append(errs, fmt.Errorf("%s.timezone: %w", field, err))
+			}
+		}
+
+		for day, ranges := range ch.Days {
+			if _, ok := weekDays[day]; !ok {
+				errs = append(errs, fmt.Errorf("%s.days: %q is not a lower case week day", field, day))
+			}
+
+			for _, hours := range ranges {
+				from, to, ok := strings.Cut(hours, "-")
+				if !ok {
+					errs = append(errs, fmt.Errorf("%s.days.%s: %q must look like 09:00-17:00", field, day, hours))
+					continue
+				}
+
+				start, err := parseClock(from)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s.days.%s: %q: %w", field, day, hours, err))
+					continue
+				}
+				end, err := parseClock(to)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s.days.%s: %q: %w", field, day, hours, err))
+					continue
+				}
+				if end <= start {
+					errs = append(errs, fmt.Errorf("%s.days.%s: %q ends before it starts", field, day, hours))
+				}
+			}
+		}
+
+		for _, holiday := range ch.Holidays {
+			if _, err := time.Parse("2006-01-02", holiday); err != nil {
+				errs = append(errs, fmt.Errorf("%s.holidays: %q must look like 2006-01-02", field, holiday))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (ac autoResolveConfig) validate() error {
+	if !ac.Enabled {
+		return nil
+	}
+
+	errs := []error{validatePositive("auto_resolve.idle_timeout", ac.IdleTimeout)}
+	if ac.WarningMessage != "" {
+		errs = append(errs, validatePositive("auto_resolve.warning_grace", ac.WarningGrace))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (sc slaConfig) validate() error {
+	if !sc.Enabled {
+		return nil
+	}
+
+	errs := []error{validatePositive("sla.first_response", sc.FirstResponse)}
+	for source, d := range sc.Channels {
+		errs = append(errs, validatePositive("sla.channels."+source, d))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (qc queueMessagesConfig) validate() error {
+	if !qc.Enabled {
+		return nil
+	}
+
+	errs := []error{
+		validatePositive("queue_messages.interval", qc.Interval),
+		validatePositive("queue_messages.window", qc.Window),
+	}
+	if qc.MinGap < 0 {
+		errs = append(errs, errors.New("queue_messages.min_gap must not be negative"))
+	}
+
+	if _, err := parseQueueMessage("enqueued", qc.Enqueued); err != nil {
+		errs = append(errs, fmt.Errorf("queue_messages.enqueued is not a valid template: %w", err))
+	}
+	if _, err := parseQueueMessage("waiting", qc.Waiting); err != nil {
+		errs = append(errs, fmt.Errorf("queue_messages.waiting is not a valid template: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (fc *fakeQiscusConfig) validate() error {
+	var errs []error
+
+	if err := validatePort("fake_qiscus.port", fc.Port); err != nil {
+		errs = append(errs, err)
+	}
+
+	ids := map[int]struct{}{}
+	for i, a := range fc.Agents {
+		field := fmt.Sprintf("fake_qiscus.agents[%d]", i)
+
+		if a.ID <= 0 {
+			errs = append(errs, fmt.Errorf("%s.id must be positive", field))
+		} else if _, ok := ids[a.ID]; ok {
+			errs = append(errs, fmt.Errorf("%s.id %d is used twice", field, a.ID))
+		}
+		ids[a.ID] = struct{}{}
+
+		if a.FirstReply < 0 {
+			errs = append(errs, fmt.Errorf("%s.first_reply must not be negative", field))
+		}
+		if a.HandleTime < 0 {
+			errs = append(errs, fmt.Errorf("%s.handle_time must not be negative", field))
+		}
+		for j, st := range a.Schedule {
+			if st.After < 0 {
+				errs = append(errs, fmt.Errorf("%s.schedule[%d].after must not be negative", field, j))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (rc *recorderConfig) validate() error {
+	if rc.Enabled && rc.Path == "" {
+		return errors.New("recorder.path is required when the recorder is enabled")
+	}
+
+	return nil
+}
+
+func (rc *replayConfig) validate() error {
+	var errs []error
+
+	if err := validateHTTPURL("replay.target", rc.Target); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch rc.Pacing {
+	case "original", "fixed":
+	case "accelerated":
+		if rc.Speed <= 0 {
+			errs = append(errs, errors.New("replay.speed must be positive"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("replay.pacing: %q is not one of original, accelerated or fixed", rc.Pacing))
+	}
+
+	if rc.Interval < 0 {
+		errs = append(errs, errors.New("replay.interval must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (hc *handleTimeConfig) validate(field string) error {
+	var errs []error
+
+	switch hc.Distribution {
+	case "fixed", "exponential":
+		if err := validatePositive(field+".mean", hc.Mean); err != nil {
+			errs = append(errs, err)
+		}
+	case "uniform":
+		if hc.Min < 0 {
+			errs = append(errs, fmt.Errorf("%s.min must not be negative", field))
+		}
+		if hc.Max < hc.Min {
+			errs = append(errs, fmt.Errorf("%s.max must not be below %s.min", field, field))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s.distribution: %q is not one of fixed, uniform or exponential", field, hc.Distribution))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (lc *loadgenConfig) validate() error {
+	var errs []error
+
+	if lc.Rate <= 0 {
+		errs = append(errs, errors.New("loadgen.rate must be positive"))
+	}
+	if err := validatePositive("loadgen.duration", lc.Duration); err != nil {
+		errs = append(errs, err)
+	}
+	if lc.Agents == 0 {
+		errs = append(errs, errors.New("loadgen.agents must be positive"))
+	}
+	if err := lc.HandleTime.validate("loadgen.handle_time"); err != nil {
+		errs = append(errs, err)
+	}
+	if lc.Warmup < 0 {
+		errs = append(errs, errors.New("loadgen.warmup must not be negative"))
+	}
+	if lc.Drain < 0 {
+		errs = append(errs, errors.New("loadgen.drain must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (sc *simulateConfig) validate(tenants []string) error {
+	var errs []error
+
+	switch sc.Source {
+	case "postgres":
+	case "jsonl":
+		if sc.Path == "" {
+			errs = append(errs, errors.New("simulate.path is required when the source is jsonl"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("simulate.source: %q is not one of postgres or jsonl", sc.Source))
+	}
+
+	if sc.Tenant != "" && !slices.Contains(tenants, sc.Tenant) {
+		errs = append(errs, fmt.Errorf("simulate.tenant: %q is not a configured tenant", sc.Tenant))
+	}
+
+	if !sc.From.IsZero() && !sc.To.IsZero() && !sc.To.After(sc.From) {
+		errs = append(errs, errors.New("simulate.to must be after simulate.from"))
+	}
+
+	for i, strategy := range sc.Strategies {
+		switch strategy {
+		case BackendRedis, BackendQiscusCandidate, BackendQiscusAllocate, BackendHybrid:
+		default:
+			errs = append(errs, fmt.Errorf("simulate.strategies[%d]: %q is not an allocation backend", i, strategy))
+		}
+	}
+
+	for i, capacity := range sc.Capacities {
+		if capacity == 0 {
+			errs = append(errs, fmt.Errorf("simulate.capacities[%d] must be positive", i))
+		}
+	}
+
+	if err := sc.HandleTime.validate("simulate.handle_time"); err != nil {
+		errs = append(errs, err)
+	}
+
+	for i, a := range sc.Agents {
+		field := fmt.Sprintf("simulate.agents[%d]", i)
+		if a.ID <= 0 {
+			errs = append(errs, fmt.Errorf("%s.id must be positive", field))
+		}
+		for j, w := range a.Online {
+			if !w.To.After(w.From) {
+				errs = append(errs, fmt.Errorf("%s.online[%d].to must be after from", field, j))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func redactConnectionString(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		// key=value connection strings may hold a password anywhere
+		if strings.Contains(s, "password=") {
+			return redactedSecret
+		}
+		return s
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedSecret)
+	}
+
+	return u.String()
+}
+
+// Redacted renders the configuration as YAML without any secret.
+func (c config) Redacted() string {
+	if c.QiscusConfig.SecretKey != "" {
+		c.QiscusConfig.SecretKey = redactedSecret
+	}
+	if c.QiscusConfig.Password != "" {
+		c.QiscusConfig.Password = redactedSecret
+	}
+	c.DBConfig.ConnectionString = redactConnectionString(c.DBConfig.ConnectionString)
+
+	keys := make([]apiKeyConfig, len(c.Admin.Keys))
+	for i, k := range c.Admin.Keys {
+		k.Key = redactedSecret
+		keys[i] = k
+	}
+	c.Admin.Keys = keys
+
+	tenants := make([]tenantConfig, len(c.Tenants))
+	for i, tc := range c.Tenants {
+		tenants[i] = tc.redacted()
+	}
+	c.Tenants = tenants
+	c.byTenant = nil
+
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("cannot render config: %v", err)
+	}
+
+	return string(out)
+}
+
+func (tc tenantConfig) redacted() tenantConfig {
+	qiscus, ok := tc.Overrides["qiscus"].(map[interface{}]interface{})
+	if !ok {
+		return tc
+	}
+
+	redactedQiscus := make(map[interface{}]interface{}, len(qiscus))
+	for k, v := range qiscus {
+		if k == "secret_key" || k == "password" {
+			v = redactedSecret
+		}
+		redactedQiscus[k] = v
+	}
+
+	overrides := make(map[string]interface{}, len(tc.Overrides))
+	for k, v := range tc.Overrides {
+		overrides[k] = v
+	}
+	overrides["qiscus"] = redactedQiscus
+	tc.Overrides = overrides
+
+	return tc
+}